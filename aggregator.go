@@ -0,0 +1,615 @@
+package grafsy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Default interval of saving of aggregation state. In seconds.
+const defaultAggrStateInterval = 10
+
+// Maximum amount of attempts to forward partial state to the central grafsy
+const maxAggrForwardAttempts = 3
+
+// Maximum amount of partial states waiting for forwarding
+const aggrForwardQueueSize = 10
+
+// Default time to wait for forwarded partial states after the end of interval. In seconds.
+const defaultAggrGrace = 5
+
+// Partial aggregation state of intervals, which are not sent yet
+type aggregator struct {
+	mu sync.Mutex
+
+	sumPrefix   string
+	avgPrefix   string
+	minPrefix   string
+	maxPrefix   string
+	timerPrefix string
+
+	// Percentiles and buckets of timers.
+	percentiles []float64
+	buckets     []float64
+
+	// Aggregation interval. In seconds.
+	interval int64
+
+	// Time to wait for forwarded states after the end of interval on the central grafsy. In seconds.
+	grace int64
+
+	// End of the current interval, aggregated metrics get it as a timestamp.
+	// Intervals are aligned, so states of different instances have the same deadlines.
+	deadline int64
+
+	// End of the last sent interval. States of sent intervals are rejected.
+	sent int64
+
+	// Maximum amount of metrics and raw values of timers added during interval.
+	maxSize int
+
+	// Intervals by deadline.
+	windows map[int64]*aggrWindow
+
+	// Identifier of this instance in forwarded states.
+	source string
+}
+
+// Aggregation of a single interval
+type aggrWindow struct {
+	metrics map[string]*metricData
+	timers  map[string]*timerData
+
+	// Amount of metrics and raw values of timers.
+	size int
+
+	// Sources of merged states, to not merge retried state twice.
+	merged map[string]bool
+}
+
+// Aggregated value of metric in the state file
+type aggrStateValue struct {
+	Value  float64 `json:"value"`
+	Amount int64   `json:"amount"`
+}
+
+// Raw values of timer in the state file and summary of values in forwarded state
+type aggrStateTimer struct {
+	Path   string       `json:"path"`
+	Tags   []string     `json:"tags,omitempty"`
+	Values []float64    `json:"values,omitempty"`
+	Sketch *timerSketch `json:"sketch,omitempty"`
+}
+
+// Interval in the state file and forwarded state
+type aggrState struct {
+	// Identifier of grafsy, which forwarded the state.
+	Source string `json:"source,omitempty"`
+
+	Deadline int64                     `json:"deadline"`
+	Metrics  map[string]aggrStateValue `json:"metrics"`
+	Timers   map[string]aggrStateTimer `json:"timers"`
+}
+
+// Create aggregator from config
+func (conf *Config) generateAggregator() *aggregator {
+	hostname, _ := os.Hostname()
+	now := time.Now().Unix()
+	a := &aggregator{
+		sumPrefix:   conf.SumPrefix,
+		avgPrefix:   conf.AvgPrefix,
+		minPrefix:   conf.MinPrefix,
+		maxPrefix:   conf.MaxPrefix,
+		timerPrefix: conf.TimerPrefix,
+		percentiles: conf.TimerPercentiles,
+		buckets:     conf.TimerBuckets,
+		interval:    int64(conf.AggrInterval),
+		maxSize:     conf.AggrPerSecond * conf.AggrInterval,
+		windows:     make(map[int64]*aggrWindow),
+		source:      fmt.Sprintf("%s:%d", hostname, time.Now().UnixNano()),
+	}
+	a.deadline = a.align(now + 1)
+	if conf.AggrCentral {
+		a.grace = int64(conf.AggrGrace)
+	}
+	return a
+}
+
+// Create queue of partial aggregations to forward. Return nil if forwarding is disabled.
+func (conf *Config) generateAggrForwardChannel() chan *aggrState {
+	if conf.AggrForward == "" {
+		return nil
+	}
+	return make(chan *aggrState, aggrForwardQueueSize)
+}
+
+// Create client to forward partial aggregations. Return nil if forwarding is disabled.
+func (conf *Config) generateAggrForwarder() *http.Client {
+	if conf.AggrForward == "" {
+		return nil
+	}
+	return &http.Client{Timeout: time.Duration(conf.ConnectTimeout) * time.Second}
+}
+
+// Get the end of interval, which contains the timestamp
+func (a *aggregator) align(timestamp int64) int64 {
+	return timestamp + (a.interval-timestamp%a.interval)%a.interval
+}
+
+// Get the interval by deadline. Lock must be held by caller.
+func (a *aggregator) window(deadline int64) *aggrWindow {
+	w, ok := a.windows[deadline]
+	if !ok {
+		w = &aggrWindow{
+			metrics: make(map[string]*metricData),
+			timers:  make(map[string]*timerData),
+			merged:  make(map[string]bool),
+		}
+		a.windows[deadline] = w
+	}
+	return w
+}
+
+// Merge value of metric into its aggregation. Amount is used only for average.
+func (a *aggregator) merge(w *aggrWindow, name string, value float64, amount int64) {
+	data, exist := w.metrics[name]
+	if !exist {
+		data = &metricData{}
+		w.metrics[name] = data
+		w.size++
+	}
+
+	if strings.HasPrefix(name, a.sumPrefix) {
+		data.value += value
+	} else if strings.HasPrefix(name, a.avgPrefix) {
+		data.value += value
+		data.amount += amount
+	} else if strings.HasPrefix(name, a.minPrefix) {
+		if !exist || data.value > value {
+			data.value = value
+		}
+	} else if strings.HasPrefix(name, a.maxPrefix) {
+		if data.value < value {
+			data.value = value
+		}
+	}
+}
+
+// Merge raw values and sketch of timer
+func (a *aggregator) mergeTimer(w *aggrWindow, name string, path string, tags []string, sketch *timerSketch, values ...float64) {
+	timer, ok := w.timers[name]
+	if !ok {
+		timer = &timerData{path: strings.TrimPrefix(path, a.timerPrefix), tags: tags}
+		w.timers[name] = timer
+	}
+	timer.values = append(timer.values, values...)
+	w.size += len(values)
+	if sketch != nil {
+		if timer.sketch == nil {
+			timer.sketch = &timerSketch{}
+		}
+		timer.sketch.merge(sketch)
+	}
+}
+
+// Add metric to the current interval. Return false if the interval is full.
+func (a *aggregator) add(m Metric) bool {
+	name := m.Name()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w := a.window(a.deadline)
+	if a.timerPrefix != "" && strings.HasPrefix(name, a.timerPrefix) {
+		if w.size >= a.maxSize {
+			return false
+		}
+		a.mergeTimer(w, name, m.Path, m.Tags, nil, m.Value)
+		return true
+	}
+	if _, ok := w.metrics[name]; !ok && w.size >= a.maxSize {
+		return false
+	}
+	a.merge(w, name, m.Value, 1)
+	return true
+}
+
+// Return aggregated metrics of intervals, which ended before now more than grace period ago.
+// Start a new interval if the current one ended.
+func (a *aggregator) flush(now int64) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.next(now)
+
+	var result []string
+	for deadline, w := range a.windows {
+		if deadline+a.grace > now {
+			continue
+		}
+		for metricName, metricData := range w.metrics {
+			value := metricData.value
+			var prefix string
+
+			if strings.HasPrefix(metricName, a.sumPrefix) {
+				prefix = a.sumPrefix
+			} else if strings.HasPrefix(metricName, a.avgPrefix) {
+				value = metricData.value / float64(metricData.amount)
+				prefix = a.avgPrefix
+			} else if strings.HasPrefix(metricName, a.minPrefix) {
+				prefix = a.minPrefix
+			} else if strings.HasPrefix(metricName, a.maxPrefix) {
+				prefix = a.maxPrefix
+			}
+			result = append(result, fmt.Sprintf("%s %.2f %d", strings.Replace(metricName, prefix, "", -1), value, deadline))
+		}
+		for _, timer := range w.timers {
+			for _, m := range timer.metrics(a.percentiles, a.buckets, deadline) {
+				result = append(result, m.String())
+			}
+		}
+		a.remove(deadline)
+	}
+	return result
+}
+
+// Start the next interval if the current one ended before now. Lock must be held by caller.
+func (a *aggregator) next(now int64) {
+	if now >= a.deadline {
+		a.deadline = a.align(now + 1)
+	}
+}
+
+// Forget the sent interval. Lock must be held by caller.
+func (a *aggregator) remove(deadline int64) {
+	delete(a.windows, deadline)
+	if deadline > a.sent {
+		a.sent = deadline
+	}
+}
+
+// Get the end of the last sent interval
+func (a *aggregator) lastSent() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sent
+}
+
+// Check if there is nothing aggregated
+func (a *aggregator) empty() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.windows) == 0
+}
+
+// Get the state of the interval. Lock must be held by caller.
+// Raw values of timers are replaced by sketches in state for forwarding.
+func (a *aggregator) state(deadline int64, forward bool) *aggrState {
+	w := a.windows[deadline]
+	state := &aggrState{
+		Deadline: deadline,
+		Metrics:  make(map[string]aggrStateValue, len(w.metrics)),
+		Timers:   make(map[string]aggrStateTimer, len(w.timers)),
+	}
+	for name, data := range w.metrics {
+		state.Metrics[name] = aggrStateValue{Value: data.value, Amount: data.amount}
+	}
+	for name, timer := range w.timers {
+		stateTimer := aggrStateTimer{Path: a.timerPrefix + timer.path, Tags: timer.tags, Values: timer.values, Sketch: timer.sketch}
+		if forward {
+			stateTimer.Values, stateTimer.Sketch = nil, timer.summary()
+		}
+		state.Timers[name] = stateTimer
+	}
+	return state
+}
+
+// Merge the state into the interval with the same deadline.
+// Return false if the state of the same source and interval was already merged.
+func (a *aggregator) mergeState(state *aggrState) (bool, error) {
+	deadline := a.align(state.Deadline)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if deadline <= a.sent {
+		return false, errors.Errorf("interval with deadline %d is already sent", deadline)
+	}
+	if deadline > a.deadline+a.interval {
+		return false, errors.Errorf("interval with deadline %d is in the future", deadline)
+	}
+
+	w := a.window(deadline)
+	if state.Source != "" {
+		if w.merged[state.Source] {
+			return false, nil
+		}
+		w.merged[state.Source] = true
+	}
+	for name, value := range state.Metrics {
+		a.merge(w, name, value.Value, value.Amount)
+	}
+	for name, timer := range state.Timers {
+		a.mergeTimer(w, name, timer.Path, timer.Tags, timer.Sketch, timer.Values...)
+	}
+	return true, nil
+}
+
+// Return partial states of intervals, which ended before now, instead of aggregated metrics.
+// Start a new interval if the current one ended.
+func (a *aggregator) partial(now int64) []*aggrState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.next(now)
+
+	var states []*aggrState
+	for deadline := range a.windows {
+		if deadline > now {
+			continue
+		}
+		state := a.state(deadline, true)
+		state.Source = a.source
+		states = append(states, state)
+		a.remove(deadline)
+	}
+	return states
+}
+
+// Save states of all intervals to file atomically
+func (a *aggregator) save(file string) error {
+	a.mu.Lock()
+	states := make([]*aggrState, 0, len(a.windows))
+	for deadline := range a.windows {
+		states = append(states, a.state(deadline, false))
+	}
+	data, err := json.Marshal(states)
+	a.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode aggregation state")
+	}
+
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "Unable to save aggregation state")
+	}
+	return errors.Wrap(os.Rename(tmp, file), "Unable to save aggregation state")
+}
+
+// Restore states from file and merge them with intervals of the same deadlines.
+// States of intervals from the past are sent with their own timestamps.
+// The file is removed to not restore the state twice.
+func (a *aggregator) load(file string) error {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Unable to read aggregation state")
+	}
+	var states []*aggrState
+	if err = json.Unmarshal(data, &states); err != nil {
+		return errors.Wrap(err, "Unable to decode aggregation state")
+	}
+
+	for _, state := range states {
+		if _, err = a.mergeState(state); err != nil {
+			return errors.Wrap(err, "Unable to restore aggregation state")
+		}
+	}
+	return errors.Wrap(os.Remove(file), "Unable to remove aggregation state")
+}
+
+// Move metrics from aggregation channel to the current interval
+func (s Server) drainAggrChannel() {
+	dropped := 0
+	defer func() {
+		if dropped > 0 {
+			s.Lc.lg.Printf("Too many metrics in aggregation interval, dropped %d metrics", dropped)
+			s.Mon.Increase(&s.Mon.serverStat.aggrDropped, dropped)
+		}
+	}()
+
+	chanSize := len(s.Lc.aggrChannel)
+	for i := 0; i < chanSize; i++ {
+		select {
+		case m := <-s.Lc.aggrChannel:
+			if !s.Lc.aggregator.add(m) {
+				dropped++
+			}
+		default:
+			// The channel is drained concurrently on shutdown
+			return
+		}
+	}
+}
+
+// SaveAggrState saves partial aggregation state to AggrStateFile to restore it after restart.
+// It must be called on shutdown.
+func (s Server) SaveAggrState() error {
+	if s.Conf.AggrStateFile == "" {
+		return nil
+	}
+	s.drainAggrChannel()
+	return s.Lc.aggregator.save(s.Conf.AggrStateFile)
+}
+
+// Restore partial aggregation state from AggrStateFile
+func (s Server) loadAggrState() {
+	if s.Conf.AggrStateFile == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Conf.AggrStateFile), 0750); err != nil {
+		s.Lc.lg.Println(err)
+	}
+	if err := s.Lc.aggregator.load(s.Conf.AggrStateFile); err != nil {
+		s.Lc.lg.Println(err)
+	}
+}
+
+// Put partial states of ended intervals into the forwarding queue, drop them if the queue is full
+func (s Server) queueAggrStates(now int64) {
+	for _, state := range s.Lc.aggregator.partial(now) {
+		select {
+		case s.Lc.aggrForwardChannel <- state:
+		default:
+			series := len(state.Metrics) + len(state.Timers)
+			s.Lc.lg.Printf("Too many partial aggregation states in the forwarding queue, drop %d series with deadline %d", series, state.Deadline)
+			s.Mon.Increase(&s.Mon.serverStat.aggrForwardDropped, series)
+		}
+	}
+}
+
+// Forward queued partial states to the central grafsy, so slow forwards do not block aggregation
+func (s Server) forwardAggrStates() {
+	for state := range s.Lc.aggrForwardChannel {
+		s.sendAggrState(state)
+	}
+}
+
+// Forward partial state to the central grafsy.
+// Failed forward is retried every second up to maxAggrForwardAttempts, state rejected by the central grafsy is dropped.
+func (s Server) sendAggrState(state *aggrState) {
+	series := len(state.Metrics) + len(state.Timers)
+	for attempt := 1; ; attempt++ {
+		retry, err := s.forwardAggrState(state)
+		if err == nil {
+			s.Mon.Increase(&s.Mon.serverStat.aggrForwarded, series)
+			return
+		}
+		s.Lc.lg.Println(err)
+		s.Mon.Increase(&s.Mon.serverStat.aggrForwardErrors, 1)
+		if !retry || attempt >= maxAggrForwardAttempts {
+			s.Lc.lg.Printf("Drop partial aggregation state of %d series with deadline %d", series, state.Deadline)
+			s.Mon.Increase(&s.Mon.serverStat.aggrForwardDropped, series)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Send compressed partial state to the central grafsy. Return true if the failed forward may be retried.
+func (s Server) forwardAggrState(state *aggrState) (bool, error) {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if err := json.NewEncoder(gz).Encode(state); err != nil {
+		return false, errors.Wrap(err, "Unable to encode aggregation state")
+	}
+	if err := gz.Close(); err != nil {
+		return false, errors.Wrap(err, "Unable to compress aggregation state")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Conf.AggrForward, &body)
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to forward aggregation state")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := s.Lc.aggrForwarder.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "Unable to forward aggregation state")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		// The same state will be rejected again
+		retry := resp.StatusCode < 400 || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, errors.New("Unable to forward aggregation state: " + resp.Status)
+	}
+	return false, nil
+}
+
+// Check partial state forwarded by other grafsy instance.
+// Names must have aggregation prefixes and pass allowedNames and filters, values must be finite.
+func (s Server) validateAggrState(state *aggrState) error {
+	if state.Deadline <= 0 {
+		return errors.New("deadline must be positive")
+	}
+	timerPrefix := s.Conf.TimerPrefix
+	check := func(name string, values ...float64) (Metric, error) {
+		for _, value := range values {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return Metric{}, errors.New("value of " + name + " is not finite")
+			}
+		}
+		m, reason := s.validateMetric(fmt.Sprintf("%s 0 %d", name, state.Deadline))
+		if reason != "" {
+			return m, errors.New(name + " is invalid: " + reason)
+		}
+		if m.Name() != name || !s.Lc.aggrRegexp.MatchString(m.Path) || !s.filterMetric(m) {
+			return m, errors.New(name + " is not allowed")
+		}
+		return m, nil
+	}
+
+	for name, value := range state.Metrics {
+		if _, err := check(name, value.Value); err != nil {
+			return err
+		}
+		if timerPrefix != "" && strings.HasPrefix(name, timerPrefix) {
+			return errors.New(name + " must be a timer")
+		}
+		if strings.HasPrefix(name, s.Conf.AvgPrefix) && value.Amount <= 0 {
+			return errors.New("amount of " + name + " must be positive")
+		}
+	}
+	for name, timer := range state.Timers {
+		if timerPrefix == "" || !strings.HasPrefix(name, timerPrefix) {
+			return errors.New(name + " is not a timer")
+		}
+		if len(timer.Values) == 0 && (timer.Sketch == nil || timer.Sketch.Count <= 0) {
+			return errors.New("timer " + name + " has no values")
+		}
+		values := timer.Values
+		if timer.Sketch != nil {
+			values = append([]float64{timer.Sketch.Sum, timer.Sketch.Min, timer.Sketch.Max}, values...)
+		}
+		m, err := check(name, values...)
+		if err != nil {
+			return err
+		}
+		// Path and tags are taken from the validated name
+		timer.Path, timer.Tags = m.Path, m.Tags
+		state.Timers[name] = timer
+	}
+	return nil
+}
+
+// Receive partial aggregation state from other grafsy instances and merge it into the interval with the same deadline
+func (s *Server) handleAggrState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := httpRequestBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+
+	var state aggrState
+	if err = json.NewDecoder(body).Decode(&state); err != nil {
+		http.Error(w, errors.Wrap(err, "can not decode aggregation state").Error(), http.StatusBadRequest)
+		return
+	}
+	if err = s.validateAggrState(&state); err != nil {
+		http.Error(w, errors.Wrap(err, "invalid aggregation state").Error(), http.StatusBadRequest)
+		return
+	}
+	// Retried state, which was merged before the forwarder got the response, is accepted again
+	merged, err := s.Lc.aggregator.mergeState(&state)
+	if err != nil {
+		// The state can not be merged later, so it must not be retried
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if merged {
+		s.Mon.Increase(&s.Mon.serverStat.aggrMerged, len(state.Metrics)+len(state.Timers))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,277 @@
+package grafsy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// Types of backends
+const (
+	// Carbon receiver of Graphite plaintext protocol over TCP
+	backendTCP = "tcp"
+
+	// HTTP endpoint accepting POST requests
+	backendHTTP = "http"
+
+	// Prometheus remote_write endpoint
+	backendPrometheus = "prometheus"
+)
+
+// Formats of data sent to HTTP backends
+const (
+	backendFormatGraphite = "graphite"
+	backendFormatInflux   = "influx"
+)
+
+// Default amount of metrics per request to HTTP backends
+const defaultBackendBatchSize = 1000
+
+// Default template to map Graphite path to Prometheus labels
+const defaultBackendPromTemplate = "name"
+
+// Connection to a backend.
+type backendConn interface {
+	// Write a single metric. It might be buffered until flush.
+	// On error it returns *sendError with metrics, which were not sent.
+	write(metric string) error
+
+	// Send buffered metrics.
+	// On error it returns *sendError with metrics, which were not sent.
+	flush() error
+
+	// Close connection. Buffered metrics are not sent.
+	close()
+}
+
+// The error of sending, which contains metrics which were not sent and must be saved for retry
+type sendError struct {
+	err    error
+	unsent []string
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
+}
+
+// Metrics, which were not sent because of the error
+func unsentMetrics(err error) []string {
+	if sendErr, ok := err.(*sendError); ok {
+		return sendErr.unsent
+	}
+	return nil
+}
+
+// Name of the backend for monitoring path
+func monitoringName(carbonAddr string) string {
+	return strings.NewReplacer(".", "_", "://", "_", "/", "_").Replace(carbonAddr)
+}
+
+// Plaintext TCP connection to carbon receiver
+type tcpConn struct {
+	c          *Client
+	carbonAddr string
+	conn       net.Conn
+}
+
+func (t *tcpConn) write(metric string) error {
+	err := t.c.tryToSendToGraphite(metric, t.carbonAddr, t.conn)
+	if err != nil {
+		return &sendError{err: err, unsent: []string{metric}}
+	}
+	return nil
+}
+
+func (t *tcpConn) flush() error {
+	return nil
+}
+
+func (t *tcpConn) close() {
+	t.conn.Close()
+}
+
+// Connection to HTTP or Prometheus remote_write backend, which sends metrics in batches
+type httpConn struct {
+	c          *Client
+	carbonAddr string
+	backend    *Backend
+	client     *http.Client
+	batch      []string
+
+	// Template to map Graphite path to Prometheus labels
+	template pathTemplate
+}
+
+func (h *httpConn) write(metric string) error {
+	h.batch = append(h.batch, strings.Replace(metric, "HOSTNAME", h.c.Lc.hostname, -1))
+	if len(h.batch) >= h.backend.BatchSize {
+		return h.flush()
+	}
+	return nil
+}
+
+// Convert metric in Graphite format <name>;tag=value <value> <timestamp> to InfluxDB line protocol
+func graphiteToInflux(metric string) (string, bool) {
+	split := strings.Fields(metric)
+	if len(split) != 3 {
+		return "", false
+	}
+	nameAndTags := strings.Split(split[0], ";")
+	var line strings.Builder
+	line.WriteString(strings.NewReplacer(",", "\\,", " ", "\\ ").Replace(nameAndTags[0]))
+	for _, tag := range nameAndTags[1:] {
+		line.WriteByte(',')
+		line.WriteString(strings.NewReplacer(",", "\\,", " ", "\\ ").Replace(tag))
+	}
+	line.WriteString(" value=" + split[1] + " " + split[2] + "000000000")
+	return line.String(), true
+}
+
+// Build the body of request from the batch.
+// Return the body and amount of metrics which can not be converted to the format of backend.
+func (h *httpConn) body(batch []string) (io.Reader, int, error) {
+	if h.backend.Type == backendPrometheus {
+		series, invalid := graphiteToPromSeries(batch, h.template)
+		return bytes.NewReader(snappy.Encode(nil, encodePromWriteRequest(series))), invalid, nil
+	}
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if h.backend.Gzip {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+
+	invalid := 0
+	for _, metric := range batch {
+		if h.backend.Format == backendFormatInflux {
+			var ok bool
+			if metric, ok = graphiteToInflux(metric); !ok {
+				invalid++
+				continue
+			}
+		}
+		io.WriteString(w, metric+"\n")
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return &buf, invalid, nil
+}
+
+// Send buffered batch
+func (h *httpConn) flush() error {
+	if len(h.batch) == 0 {
+		return nil
+	}
+	batch := h.batch
+	h.batch = nil
+	return h.send(batch)
+}
+
+// Send the batch in a single request.
+// Server errors (5xx and 429), network errors and other client errors, e.g. authentication, keep the batch for retry.
+// If the backend rejects the content of the batch (400, 413 or 422), the batch is split in halves to send
+// all metrics which are accepted and drop only rejected ones.
+func (h *httpConn) send(batch []string) error {
+	body, invalid, err := h.body(batch)
+	if err != nil {
+		return &sendError{err: err, unsent: batch}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.carbonAddr, body)
+	if err != nil {
+		return &sendError{err: err, unsent: batch}
+	}
+	if h.backend.Type == backendPrometheus {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	} else {
+		req.Header.Set("Content-Type", "text/plain")
+		if h.backend.Gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+	}
+	for name, value := range h.backend.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return &sendError{err: err, unsent: batch}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+	default:
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			if invalid > 0 {
+				h.c.Lc.lg.Printf("Can not convert %d metrics for %s", invalid, h.carbonAddr)
+				h.c.Mon.Increase(&h.c.Mon.clientStat[h.carbonAddr].dropped, invalid)
+			}
+			h.c.Mon.Increase(&h.c.Mon.clientStat[h.carbonAddr].sent, len(batch)-invalid)
+			return nil
+		}
+		return &sendError{err: errors.New("backend error " + resp.Status), unsent: batch}
+	}
+
+	if len(batch) == 1 {
+		// The metric will never be accepted, so there is no reason to retry it
+		h.c.Lc.lg.Printf("Backend %s rejected metric '%s': %s", h.carbonAddr, batch[0], resp.Status)
+		h.c.Mon.Increase(&h.c.Mon.clientStat[h.carbonAddr].dropped, 1)
+		return nil
+	}
+	half := len(batch) / 2
+	if err = h.send(batch[:half]); err != nil {
+		return &sendError{err: err, unsent: append(unsentMetrics(err), batch[half:]...)}
+	}
+	return h.send(batch[half:])
+}
+
+func (h *httpConn) close() {
+	h.batch = nil
+}
+
+// Connect to the backend
+func (c *Client) dialBackend(carbonAddr string) (backendConn, error) {
+	// Timeout for writing metrics is the rest of we have for client interval
+	writeTimeout := time.Duration(c.Conf.ClientSendInterval-c.Conf.ConnectTimeout-1) * time.Second
+
+	backend, ok := c.Lc.backends[carbonAddr]
+	if ok && (backend.Type == backendHTTP || backend.Type == backendPrometheus) {
+		return &httpConn{
+			c:          c,
+			carbonAddr: carbonAddr,
+			backend:    backend,
+			client:     &http.Client{Timeout: time.Duration(c.Conf.ConnectTimeout)*time.Second + writeTimeout},
+			template:   parsePathTemplate(backend.Template),
+		}, nil
+	}
+
+	// Try to dial to Graphite server. If ClientSendInterval is 10 seconds - dial should be no longer than 1 second
+	conn, err := net.DialTimeout("tcp", carbonAddr, time.Duration(c.Conf.ConnectTimeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	// We set dead line for connection to write. It should be the rest of we have for client interval
+	err = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Can not set deadline for connection")
+	}
+	return &tcpConn{c: c, carbonAddr: carbonAddr, conn: conn}, nil
+}
@@ -0,0 +1,185 @@
+package grafsy
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maximum amount of prefixes tracked per monitoring interval.
+// The rest is tracked under otherCardinalityPrefix.
+const maxCardinalityPrefixes = 10000
+
+// Name of the prefix for metrics which do not fit into maxCardinalityPrefixes.
+const otherCardinalityPrefix = "other"
+
+// Precision of HyperLogLog sketches: 2^10 registers give about 3% standard error
+const hllPrecision = 10
+
+// HyperLogLog sketch to estimate amount of distinct series
+type hyperLogLog [1 << hllPrecision]uint8
+
+// Hash the series name with FNV-1a and mix the bits with splitmix64 finalizer for better distribution
+func hllHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add series name to the sketch
+func (h *hyperLogLog) add(name string) {
+	x := hllHash(name)
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h[i] {
+		h[i] = rank
+	}
+}
+
+// Estimate amount of distinct series added to the sketch
+func (h *hyperLogLog) estimate() int {
+	m := float64(len(h))
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more precise for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(estimate + 0.5)
+}
+
+// Traffic of a single prefix
+type prefixTraffic struct {
+	series hyperLogLog
+	points int
+}
+
+// Cardinality of a prefix in reports
+type prefixCardinality struct {
+	// Prefix of metric path.
+	Prefix string `json:"prefix"`
+
+	// Estimated amount of distinct series.
+	Series int `json:"series"`
+
+	// Amount of points.
+	Points int `json:"points"`
+}
+
+// Tracker of distinct series and points per prefix of metric path since the last reset
+type cardinalityTracker struct {
+	mu sync.Mutex
+
+	// Amount of nodes of metric path in the prefix.
+	depth int
+
+	// Beginning of tracking.
+	since time.Time
+
+	prefixes map[string]*prefixTraffic
+}
+
+// Create tracker from config. Return nil if tracking is disabled.
+func (conf *Config) generateCardinalityTracker() *cardinalityTracker {
+	if conf.CardinalityPrefixDepth <= 0 {
+		return nil
+	}
+	return &cardinalityTracker{
+		depth:    conf.CardinalityPrefixDepth,
+		since:    time.Now(),
+		prefixes: make(map[string]*prefixTraffic),
+	}
+}
+
+// Count a point of metric
+func (c *cardinalityTracker) add(m Metric) {
+	prefix := pathPrefix(m.Path, c.depth)
+	name := m.Name()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	traffic, ok := c.prefixes[prefix]
+	if !ok {
+		if len(c.prefixes) >= maxCardinalityPrefixes-1 {
+			prefix = otherCardinalityPrefix
+			traffic = c.prefixes[prefix]
+		}
+		if traffic == nil {
+			traffic = &prefixTraffic{}
+			c.prefixes[prefix] = traffic
+		}
+	}
+	traffic.series.add(name)
+	traffic.points++
+}
+
+// Get up to n prefixes (all if n is 0) sorted by amount of points or series in descending order
+func (c *cardinalityTracker) top(n int, bySeries bool) []prefixCardinality {
+	c.mu.Lock()
+	result := make([]prefixCardinality, 0, len(c.prefixes))
+	for prefix, traffic := range c.prefixes {
+		result = append(result, prefixCardinality{Prefix: prefix, Series: traffic.series.estimate(), Points: traffic.points})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].Points, result[j].Points
+		if bySeries {
+			a, b = result[i].Series, result[j].Series
+		}
+		if a != b {
+			return a > b
+		}
+		return result[i].Prefix < result[j].Prefix
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// Start tracking from scratch
+func (c *cardinalityTracker) reset() {
+	c.mu.Lock()
+	c.since = time.Now()
+	c.prefixes = make(map[string]*prefixTraffic)
+	c.mu.Unlock()
+}
+
+// Dump cardinality of all prefixes since the last monitoring report in JSON.
+// Parameters: sort=series to sort by series instead of points, limit=N to return only top N prefixes.
+func (s *Server) handleCardinality(w http.ResponseWriter, r *http.Request) {
+	if s.Lc.cardinality == nil {
+		http.Error(w, "cardinality tracking is disabled", http.StatusNotFound)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	s.Lc.cardinality.mu.Lock()
+	since := s.Lc.cardinality.since.Unix()
+	s.Lc.cardinality.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Since    int64               `json:"since"`
+		Prefixes []prefixCardinality `json:"prefixes"`
+	}{since, s.Lc.cardinality.top(limit, r.URL.Query().Get("sort") == "series")})
+}
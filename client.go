@@ -38,13 +38,17 @@ func (c Client) createRetryDir() error {
 
 // Save []string to file.
 func (c Client) saveSliceToRetry(metrics []string, carbonAddr string) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
 	// If size of file is bigger, than max size we will remove lines from this file,
 	// and will call this function again to check result and write to the file.
 	// Recursion:)
 
 	c.Lc.lg.Printf("Resaving %d metrics back to the retry-file", len(metrics))
 
-	retFile := path.Join(c.Conf.RetryDir, carbonAddr)
+	retFile := path.Join(c.Conf.RetryDir, RetryFileName(carbonAddr))
 	f, err := os.OpenFile(retFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
 		c.Lc.lg.Println(err)
@@ -81,7 +85,7 @@ func (c Client) saveChannelToRetry(ch chan string, size int, carbonAddr string)
 
 	c.Lc.lg.Printf("Saving %d metrics from channel to the retry-file", size)
 
-	retFile := path.Join(c.Conf.RetryDir, carbonAddr)
+	retFile := path.Join(c.Conf.RetryDir, RetryFileName(carbonAddr))
 	f, err := os.OpenFile(retFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
 		c.Lc.lg.Println(err.Error())
@@ -110,7 +114,7 @@ func (c Client) saveChannelToRetry(ch chan string, size int, carbonAddr string)
 // Cleaning up retry-file.
 // Entire file is sorted to have newest metrics at the beginning.
 func (c Client) removeOldDataFromRetryFile(carbonAddr string) error {
-	retFile := path.Join(c.Conf.RetryDir, carbonAddr)
+	retFile := path.Join(c.Conf.RetryDir, RetryFileName(carbonAddr))
 	currentLinesInFile := getSizeInLinesFromFile(retFile)
 	if currentLinesInFile > c.Lc.fileMetricSize {
 		c.Lc.lg.Printf("I can not save to %s more, than %d. I will have to drop the rest (%d)",
@@ -143,7 +147,7 @@ func (c *Client) tryToSendToGraphite(metric string, carbonAddr string, conn net.
 //
 // And save everything to the retryFile on any error
 func (c Client) runBackend(carbonAddr string) {
-	retFile := path.Join(c.Conf.RetryDir, carbonAddr)
+	retFile := path.Join(c.Conf.RetryDir, RetryFileName(carbonAddr))
 	chanLock.Lock()
 	monChannel := c.monChannels[carbonAddr]
 	mainChannel := c.mainChannels[carbonAddr]
@@ -153,8 +157,7 @@ func (c Client) runBackend(carbonAddr string) {
 	for ; ; time.Sleep(time.Duration(c.Conf.ClientSendInterval) * time.Second) {
 		var connectionFailed bool
 
-		// Try to dial to Graphite server. If ClientSendInterval is 10 seconds - dial should be no longer than 1 second
-		conn, err := net.DialTimeout("tcp", carbonAddr, time.Duration(c.Conf.ConnectTimeout)*time.Second)
+		conn, err := c.dialBackend(carbonAddr)
 		if err != nil {
 			c.Lc.lg.Println("Can not connect to graphite server: ", err.Error())
 			c.saveChannelToRetry(monChannel, len(monChannel), carbonAddr)
@@ -163,47 +166,49 @@ func (c Client) runBackend(carbonAddr string) {
 			continue
 		}
 
-		// We set dead line for connection to write. It should be the rest of we have for client interval
-		err = conn.SetWriteDeadline(time.Now().Add(time.Duration(c.Conf.ClientSendInterval-c.Conf.ConnectTimeout-1) * time.Second))
-		if err != nil {
-			c.Lc.lg.Println("Can not set deadline for connection: ", err.Error())
-			connectionFailed = true
-		}
-
 		// We send retry file first, we have a risk to lose old data
 		// Metrics from retry file are counted as extra metrics per second to have a chance to send them
 		// Otherwise we would only save new incomming metrics and continuously lose part of buffer
-		if !connectionFailed {
-			retryFileMetrics, _ := readMetricsFromFile(retFile)
-			for numOfMetricFromFile, metricFromFile := range retryFileMetrics {
-				if numOfMetricFromFile < c.Lc.mainBufferSize {
-					err = c.tryToSendToGraphite(metricFromFile, carbonAddr, conn)
-					if err != nil {
-						c.Lc.lg.Printf("Error happened in the middle of writing retry metrics. Resaving %d metrics\n", len(retryFileMetrics[numOfMetricFromFile:]))
-						// If we failed to write a metric to graphite - something is wrong with connection
-						c.saveSliceToRetry(retryFileMetrics[numOfMetricFromFile:], carbonAddr)
-						connectionFailed = true
-						break
-					} else {
-						c.Mon.Increase(&c.Mon.clientStat[carbonAddr].fromRetry, 1)
-					}
-
-				} else {
-					c.Lc.lg.Printf("Can read only %d metrics from %s. Rest %d will be kept for the next run", numOfMetricFromFile, retFile, len(retryFileMetrics[numOfMetricFromFile:]))
-					c.saveSliceToRetry(retryFileMetrics[numOfMetricFromFile:], carbonAddr)
-					break
-				}
+		retryFileMetrics, _ := readMetricsFromFile(retFile)
+		if len(retryFileMetrics) > c.Lc.mainBufferSize {
+			c.Lc.lg.Printf("Can read only %d metrics from %s. Rest %d will be kept for the next run", c.Lc.mainBufferSize, retFile, len(retryFileMetrics)-c.Lc.mainBufferSize)
+			c.saveSliceToRetry(retryFileMetrics[c.Lc.mainBufferSize:], carbonAddr)
+			retryFileMetrics = retryFileMetrics[:c.Lc.mainBufferSize]
+		}
+		for numOfMetricFromFile, metricFromFile := range retryFileMetrics {
+			err = conn.write(metricFromFile)
+			if err != nil {
+				unsent := append(unsentMetrics(err), retryFileMetrics[numOfMetricFromFile+1:]...)
+				c.Lc.lg.Printf("Error happened in the middle of writing retry metrics. Resaving %d metrics\n", len(unsent))
+				// If we failed to write a metric to graphite - something is wrong with connection
+				c.saveSliceToRetry(unsent, carbonAddr)
+				c.Mon.Increase(&c.Mon.clientStat[carbonAddr].fromRetry, len(retryFileMetrics)-len(unsent))
+				connectionFailed = true
+				break
+			}
+		}
+		// Metrics from retry file are counted only when they are sent, buffered metrics are sent by flush
+		if !connectionFailed && len(retryFileMetrics) > 0 {
+			err = conn.flush()
+			if err != nil {
+				c.Lc.lg.Println("Can not flush retry metrics:", err.Error())
+				c.saveSliceToRetry(unsentMetrics(err), carbonAddr)
+				connectionFailed = true
 			}
+			c.Mon.Increase(&c.Mon.clientStat[carbonAddr].fromRetry, len(retryFileMetrics)-len(unsentMetrics(err)))
 		}
 
 		// Monitoring. We read it always and we reserved space for it
 		bufSize := len(monChannel)
 		if !connectionFailed {
 			for i := 0; i < bufSize; i++ {
-				err = c.tryToSendToGraphite(<-monChannel, carbonAddr, conn)
+				err = conn.write(<-monChannel)
 				if err != nil {
 					c.Lc.lg.Println("Error happened in the middle of writing monitoring metrics. Saving...")
-					c.saveChannelToRetry(monChannel, bufSize-i, carbonAddr)
+					c.saveSliceToRetry(unsentMetrics(err), carbonAddr)
+					if rest := bufSize - i - 1; rest > 0 {
+						c.saveChannelToRetry(monChannel, rest, carbonAddr)
+					}
 					connectionFailed = true
 					break
 				}
@@ -221,24 +226,37 @@ func (c Client) runBackend(carbonAddr string) {
 			for processedMainBuff := 0; processedMainBuff < bufSize; processedMainBuff = processedMainBuff + 1 {
 				metric := <-mainChannel
 
-				err = c.tryToSendToGraphite(metric, carbonAddr, conn)
+				err = conn.write(metric)
 				if err != nil {
 					c.Lc.lg.Printf("Error happened in the middle of writing metrics. Saving %d metrics\n", bufSize-processedMainBuff)
-					c.saveChannelToRetry(mainChannel, bufSize-processedMainBuff, carbonAddr)
+					c.saveSliceToRetry(unsentMetrics(err), carbonAddr)
+					if rest := bufSize - processedMainBuff - 1; rest > 0 {
+						c.saveChannelToRetry(mainChannel, rest, carbonAddr)
+					}
+					connectionFailed = true
 					break
 				}
 			}
 		} else {
 			c.saveChannelToRetry(mainChannel, bufSize, carbonAddr)
 		}
-		conn.Close()
+
+		// Send metrics buffered by the connection
+		if !connectionFailed {
+			err = conn.flush()
+			if err != nil {
+				c.Lc.lg.Println("Can not flush metrics:", err.Error())
+				c.saveSliceToRetry(unsentMetrics(err), carbonAddr)
+			}
+		}
+		conn.close()
 	}
 }
 
 // Run a client, which:
 // 1) Make monitoring and main channels per carbon server
 // 2) Launchs go routine per carbon server
-// 3) Copy metrics from monitoring and main channels to the carbon server specific
+// 3) Copy metrics from monitoring and main channels (deduplicated if enabled) to the carbon server specific
 // Should be run in separate goroutine.
 func (c Client) Run() {
 	err := c.createRetryDir()
@@ -256,6 +274,9 @@ func (c Client) Run() {
 		go c.runBackend(carbonAddr)
 	}
 
+	dedup := c.Conf.generateDeduplicator()
+	lastDedup := time.Now()
+
 	sup := supervisor(c.Conf.Supervisor)
 	for ; ; time.Sleep(time.Second) {
 		// Notify watchdog about aliveness of Client routine
@@ -264,24 +285,37 @@ func (c Client) Run() {
 		// write metrics from monitoring and main channels to the server specific channels
 		for i := 0; i < len(c.Lc.mainChannel); i++ {
 			metric := <-c.Lc.mainChannel
-			for _, carbonAddr := range c.Conf.CarbonAddrs {
-				select {
-				case c.mainChannels[carbonAddr] <- metric:
-				default:
-					c.Mon.Increase(&c.Mon.clientStat[carbonAddr].dropped, 1)
-				}
+			if dedup == nil {
+				c.copyToBackends(metric, c.mainChannels)
+			} else if !dedup.add(metric) {
+				c.Mon.Increase(&c.Mon.serverStat.deduplicated, 1)
 			}
 		}
 
-		for i := 0; i < len(c.Lc.monitoringChannel); i++ {
-			metric := <-c.Lc.monitoringChannel
-			for _, carbonAddr := range c.Conf.CarbonAddrs {
-				select {
-				case c.monChannels[carbonAddr] <- metric:
-				default:
-					c.Mon.Increase(&c.Mon.clientStat[carbonAddr].dropped, 1)
-				}
+		// Unique metrics are copied every second, duplicates are tracked for the send interval
+		if dedup != nil {
+			for _, metric := range dedup.flush() {
+				c.copyToBackends(metric, c.mainChannels)
+			}
+			if time.Since(lastDedup) >= time.Duration(c.Conf.ClientSendInterval)*time.Second {
+				dedup.reset()
+				lastDedup = time.Now()
 			}
 		}
+
+		for i := 0; i < len(c.Lc.monitoringChannel); i++ {
+			c.copyToBackends(<-c.Lc.monitoringChannel, c.monChannels)
+		}
+	}
+}
+
+// Copy metric to the server specific channels
+func (c Client) copyToBackends(metric string, channels map[string]chan string) {
+	for _, carbonAddr := range c.Conf.CarbonAddrs {
+		select {
+		case channels[carbonAddr] <- metric:
+		default:
+			c.Mon.Increase(&c.Mon.clientStat[carbonAddr].dropped, 1)
+		}
 	}
 }
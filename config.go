@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/pelletier/go-toml/v2"
@@ -16,6 +19,15 @@ import (
 // ConfigPath is the default path to the configuration file
 var ConfigPath = "/etc/grafsy/grafsy.toml"
 
+// Default amount of prefixes with most points reported in self-monitoring
+const defaultCardinalityTopN = 10
+
+// Default maximum length of a node of metric path after sanitizing
+const defaultSanitizeMaxNodeLength = 255
+
+// Default characters allowed by sanitizer, the same as in the last node of default allowedNames
+const defaultSanitizeChars = "-a-zA-Z0-9_.():/,{}=+#"
+
 // Config is the main config specified by user.
 type Config struct {
 	// Supervisor manager which is used to run Grafsy. e.g. systemd.
@@ -33,6 +45,15 @@ type Config struct {
 	// Real Carbon servers to which client will send all data
 	CarbonAddrs []string
 
+	// Backends with settings, e.g. HTTP endpoints of TSDBs.
+	// They are added to CarbonAddrs.
+	Backend []Backend
+
+	// Deduplicate points with the same name and timestamp within ClientSendInterval before sending:
+	// "first" keeps the first received value, "last" keeps the last one.
+	// Default is empty, which means deduplication is disabled.
+	Dedup string
+
 	// Timeout for connecting to graphiteAddr.
 	// Timeout for writing metrics themselves will be clientSendInterval-connectTimeout-1.
 	// Default 7. In seconds.
@@ -41,6 +62,51 @@ type Config struct {
 	// Local address:port for local daemon.
 	LocalBind string
 
+	// Local address:port for InfluxDB line protocol listener.
+	// Default is empty, which means disabled.
+	InfluxBind string
+
+	// Template to convert InfluxDB line protocol to Graphite path.
+	// Parts are "measurement", "field", "tags" or names of tags.
+	// Default is "measurement.field".
+	InfluxTemplate string
+
+	// Drop tags of InfluxDB line protocol, which are not used in InfluxTemplate,
+	// instead of converting them to Graphite tags.
+	// Default is false.
+	InfluxDropTags bool
+
+	// Local address:port for HTTP listener.
+	// Default is empty, which means disabled.
+	HTTPBind string
+
+	// Template to convert Prometheus labels to Graphite path.
+	// Parts are "name", "tags" or names of labels.
+	// Default is "name".
+	PromTemplate string
+
+	// Drop Prometheus labels, which are not used in PromTemplate,
+	// instead of converting them to Graphite tags.
+	// Default is false.
+	PromDropTags bool
+
+	// Template to convert OpenTelemetry metrics to Graphite path.
+	// Parts are "name", "tags" or names of resource and data point attributes with dots replaced by underscores.
+	// Default is "name".
+	OTLPTemplate string
+
+	// Drop OpenTelemetry attributes, which are not used in OTLPTemplate,
+	// instead of converting them to Graphite tags.
+	// Default is false.
+	OTLPDropTags bool
+
+	// Percentiles calculated for OpenTelemetry histograms.
+	// Default is [50, 90, 99].
+	OTLPPercentiles []float64
+
+	// Prometheus exposition endpoints to scrape.
+	Scrape []ScrapeTarget
+
 	// Main log file.
 	Log string
 
@@ -51,6 +117,31 @@ type Config struct {
 	// Default is false.
 	UseACL bool
 
+	// Watch metricDir with inotify and read files as soon as they are closed after writing or moved in.
+	// Works only on Linux, polling every ClientSendInterval is used as a fallback.
+	// Default is false.
+	MetricDirInotify bool
+
+	// Shell patterns of file names in metricDir, which must be ignored, e.g. temporary files of producers.
+	// E.g. [".*", "*.tmp"]
+	MetricDirIgnore []string
+
+	// Read files from subdirectories of metricDir as well.
+	// Default is false.
+	MetricDirRecursive bool
+
+	// Maximum size of a file in metricDir in bytes. Bigger files are not read.
+	// Default is 0, which means no limit.
+	MetricDirMaxFileSize int64
+
+	// Files from metricDir which contain invalid metrics or can not be read completely are moved to this directory.
+	// Default is empty, which means such files are removed.
+	QuarantineDir string
+
+	// Rules to derive the source, metric prefix and tags from the path of a file in metricDir.
+	// The first matching rule is applied.
+	MetricDirSource []MetricDirSource
+
 	// Data, which was not sent will be buffered in this directory.
 	RetryDir string
 
@@ -58,21 +149,34 @@ type Config struct {
 	RetryKeepSecs int
 
 	// Prefix for metric to sum.
-	// Do not forget to include it in allowedMetrics if you change it.
+	// Do not forget to include it in allowedNames if you change it.
 	SumPrefix string
 
 	// Prefix for metric to calculate average.
-	// Do not forget to include it in allowedMetrics if you change it.
+	// Do not forget to include it in allowedNames if you change it.
 	AvgPrefix string
 
 	// Prefix for metric to find minimal value.
-	// Do not forget to include it in allowedMetrics if you change it.
+	// Do not forget to include it in allowedNames if you change it.
 	MinPrefix string
 
 	// Prefix for metric to find maximum value.
-	// Do not forget to include it in allowedMetrics if you change it.
+	// Do not forget to include it in allowedNames if you change it.
 	MaxPrefix string
 
+	// Prefix for metric to calculate count, sum, min, max, mean, percentiles and buckets of raw values.
+	// Do not forget to include it in allowedNames if you change it.
+	// Default is empty, which disables timers.
+	TimerPrefix string
+
+	// Percentiles calculated for timers.
+	// Default is [50, 90, 99].
+	TimerPercentiles []float64
+
+	// Upper bounds of cumulative buckets calculated for timers.
+	// Default is empty, which means no buckets.
+	TimerBuckets []float64
+
 	// Summing up interval for metrics with all prefixes. In seconds.
 	AggrInterval int
 
@@ -80,6 +184,30 @@ type Config struct {
 	// If grafsy receives more metrics than aggrPerSecond*aggrInterval - rest will be dropped.
 	AggrPerSecond int
 
+	// File to save partial aggregation state on shutdown and every AggrStateInterval.
+	// The state is restored at startup and merged with new metrics.
+	// Default is empty, which disables saving of the state.
+	AggrStateFile string
+
+	// Interval of saving of aggregation state. In seconds.
+	// Default is 10.
+	AggrStateInterval int
+
+	// Time to wait for partial aggregations forwarded by other grafsy instances after the end of interval.
+	// Aggregated metrics are sent after it. Used only with AggrCentral. In seconds.
+	// Default is 5.
+	AggrGrace int
+
+	// Accept partial aggregations forwarded by other grafsy instances on /aggregate of HTTPBind.
+	// Default is false.
+	AggrCentral bool
+
+	// URL of /aggregate endpoint of the central grafsy, e.g. http://aggregator:3003/aggregate.
+	// Partial aggregations are forwarded there every aggrInterval instead of being sent to backends.
+	// The central grafsy must have the same prefixes.
+	// Default is empty, which means metrics are aggregated locally.
+	AggrForward string
+
 	// Alias to use instead of os.Hostname() result
 	Hostname string
 
@@ -88,18 +216,237 @@ type Config struct {
 	// Default is "HOSTNAME"
 	MonitoringPath string
 
+	// Replace missing, "-1" and "N" timestamps with the time of receiving.
+	// Default is false.
+	TimestampFill bool
+
+	// Convert timestamps in milliseconds, microseconds and nanoseconds to seconds.
+	// Default is false.
+	TimestampConvert bool
+
+	// Maximum age of timestamp relative to the time of receiving. In seconds.
+	// Default is 0, which means no limit.
+	TimestampMaxPast int
+
+	// Maximum distance of timestamp into the future relative to the time of receiving. In seconds.
+	// Default is 0, which means no limit.
+	TimestampMaxFuture int
+
+	// Action on timestamps outside of TimestampMaxPast and TimestampMaxFuture: "reject" or "clamp" to the limit.
+	// Default is "reject".
+	TimestampOutOfWindow string
+
 	// Regexp of allowed metric.
 	// Every metric which is not passing check against regexp will be removed.
+	// Deprecated: use AllowedNames, which is checked against the name only.
 	AllowedMetrics string
 
+	// Regexp of allowed metric names without tags.
+	// Every metric with the name, which is not passing check against regexp, will be removed.
+	AllowedNames string
+
+	// Ordered list of allow and deny rules evaluated after AllowedNames.
+	// The first matching rule decides, metrics matching no rule are allowed.
+	Filter []FilterRule
+
+	// Amount of nodes of metric path, which form the prefix for limits, e.g. 2 for servers.HOSTNAME.
+	// Default is 0, which means limits are disabled.
+	LimitPrefixDepth int
+
+	// Maximum amount of points per second per prefix. Metrics over the limit are dropped.
+	// Default is 0, which means no limit.
+	LimitPointsPerSecond int
+
+	// Maximum amount of distinct series per hour per prefix. Metrics of new series over the limit are dropped.
+	// Default is 0, which means no limit.
+	LimitSeriesPerHour int
+
+	// Amount of nodes of metric path, which form the prefix for cardinality tracking.
+	// Default is 0, which means tracking is disabled.
+	CardinalityPrefixDepth int
+
+	// Amount of prefixes with most points reported in self-monitoring.
+	// Default is 10.
+	CardinalityTopN int
+
+	// Sanitize names of metrics before validation instead of rejecting them:
+	// replace disallowed characters and whitespaces with "_", collapse duplicate dots and trim long nodes.
+	// Default is false.
+	Sanitize bool
+
+	// Maximum length of a node of metric path after sanitizing. Longer nodes are trimmed.
+	// Default is 255.
+	SanitizeMaxNodeLength int
+
+	// Characters allowed in the path and tags by sanitizer as a content of regexp character class, e.g. "-a-zA-Z0-9_.".
+	// Other characters are replaced with "_".
+	// Default is "-a-zA-Z0-9_.():/,{}=+#".
+	SanitizeChars string
+
+	// Maximum length of a metric line. Longer metrics are removed.
+	// Default is 0, which means no limit.
+	MetricMaxLength int
+
+	// Log only every N-th removed metric.
+	// Default is 1, which means every removed metric is logged.
+	InvalidLogSample int
+
 	// List of metrics to overwrite
-	Overwrite []struct {
-		// Regexp of metric to replace from config
-		ReplaceWhatRegexp string
+	Overwrite []OverwriteRule
 
-		// New metric part
-		ReplaceWith string
-	}
+	// Rules to keep a single point per series per window.
+	// The first matching rule is applied.
+	Downsample []DownsampleRule
+
+	// Rules to derive per-second rates from monotonically increasing counters.
+	// The first matching rule is applied.
+	Rate []RateRule
+
+	// Maximum gap between points of a counter to derive a rate. In seconds.
+	// Default is 600.
+	RateMaxGap int
+}
+
+// RateRule derives per-second rate from counters with matching names.
+type RateRule struct {
+	// Regexp of counter name without tags.
+	Regexp string
+
+	// Name of the rate. May contain references to submatches of Regexp, e.g. $1 or ${name}.
+	// Default is "$0.rate".
+	Output string
+
+	// Maximum value of the counter before wraparound, e.g. 4294967295 for 32-bit counters.
+	// Default is 0, which means every decrease is a reset of the counter.
+	MaxValue float64
+
+	// Send the counter itself as well.
+	// Default is false.
+	Keep bool
+}
+
+// DownsampleRule keeps a single point per window for every series with matching name.
+type DownsampleRule struct {
+	// Regexp of metric name without tags.
+	Regexp string
+
+	// Window of downsampling. Points get the timestamp of the window beginning. In seconds.
+	// Default is 60.
+	Window int
+
+	// Function to calculate the point of window: "last", "avg", "min" or "max".
+	// Default is "last".
+	Function string
+}
+
+// OverwriteRule rewrites the part of metric matching the regexp.
+// By default only the first matching rule is applied.
+type OverwriteRule struct {
+	// Name of the rule in self-monitoring.
+	// Default is rule_N, where N is the number of the rule starting from 1.
+	Name string
+
+	// Regexp of metric to replace from config
+	ReplaceWhatRegexp string
+
+	// New metric part for "replace" action or replacement of disallowed characters for "sanitize" action.
+	ReplaceWith string
+
+	// Action on the matching part: "replace", "lower", "upper" or "sanitize" to replace characters
+	// other than letters, digits, "-", "_" and "." with ReplaceWith.
+	// Default is "replace".
+	Action string
+
+	// Continue with the next rules after this one is matched.
+	Continue bool
+
+	// Stop after this rule is matched. This is the default behavior.
+	Last bool
+}
+
+// MetricDirSource describes how to treat files from a part of metricDir.
+// Name, Prefix and Tags may contain references to submatches of PathRegexp, e.g. $1 or ${team}.
+type MetricDirSource struct {
+	// Regexp of the file path relative to metricDir.
+	PathRegexp string
+
+	// Name of the source in self-monitoring.
+	Name string
+
+	// Prefix to add to every metric from the file.
+	Prefix string
+
+	// Graphite tags to add to every metric from the file.
+	Tags map[string]string
+}
+
+// FilterRule allows or denies metrics with matching names.
+type FilterRule struct {
+	// Name of the rule in self-monitoring.
+	// Default is rule_N, where N is the number of the rule starting from 1.
+	Name string
+
+	// Action for matching metrics: "allow" or "deny".
+	Action string
+
+	// Regexp of metric name without tags.
+	Regexp string
+
+	// Prefixes of metric name by nodes, e.g. "a.b" matches "a.b.c", but not "a.bc".
+	Prefixes []string
+}
+
+// Backend describes a receiver of metrics and the way to send them.
+type Backend struct {
+	// Address of carbon receiver in format host:port for "tcp" or URL for "http" and "prometheus".
+	Addr string
+
+	// Type of the backend: "tcp" for Graphite plaintext protocol, "http" for POST requests
+	// or "prometheus" for Prometheus remote_write.
+	// Default is "tcp".
+	Type string
+
+	// Format of metrics sent to "http" backend: "graphite" plaintext or "influx" line protocol.
+	// Default is "graphite".
+	Format string
+
+	// Compress bodies of requests to "http" backend with gzip.
+	// Default is false.
+	Gzip bool
+
+	// Headers of requests to "http" and "prometheus" backends, e.g. Authorization.
+	Headers map[string]string
+
+	// Maximum amount of metrics in a single request to "http" or "prometheus" backend.
+	// Default is 1000.
+	BatchSize int
+
+	// Template to map nodes of Graphite path to labels of "prometheus" backend.
+	// Parts are names of labels, "_" to skip a node and "name" for the rest of nodes joined as the metric name.
+	// Default is "name".
+	Template string
+}
+
+// ScrapeTarget describes Prometheus exposition endpoint to scrape.
+type ScrapeTarget struct {
+	// URL of the endpoint, e.g. http://localhost:9100/metrics
+	URL string
+
+	// Scraping interval. In seconds.
+	// Default is ClientSendInterval.
+	Interval int
+
+	// Timeout of scraping. In seconds.
+	// Default is ConnectTimeout.
+	Timeout int
+
+	// Prefix for every metric of the endpoint.
+	// "HOSTNAME" will be replaced with os.Hostname() result from GO.
+	Prefix string
+
+	// Template to convert Prometheus labels to Graphite path.
+	// Default is PromTemplate.
+	Template string
 }
 
 // LocalConfig is generated based on Config.
@@ -119,20 +466,65 @@ type LocalConfig struct {
 	// Main logger.
 	lg *log.Logger
 
-	// Aggregation prefix regexp.
+	// Regexp of allowed metrics. Nil if not set.
 	allowedMetrics *regexp.Regexp
 
+	// Regexp of allowed names of metrics. Nil if not set.
+	allowedNames *regexp.Regexp
+
+	// Regexp of characters replaced by sanitizer.
+	sanitizeRegexp *regexp.Regexp
+
 	// Aggregation regexp.
 	aggrRegexp *regexp.Regexp
 
 	// Custom regexps to overwrite metrics via Grafsy.
 	overwriteRegexp []*regexp.Regexp
 
+	// Compiled filter rules.
+	filters []*filterRule
+
+	// Limits per prefix. Nil if disabled.
+	limiter *prefixLimiter
+
+	// Tracker of cardinality per prefix. Nil if disabled.
+	cardinality *cardinalityTracker
+
+	// Downsampler of series. Nil if there are no rules.
+	downsampler *downsampler
+
+	// Deriver of rates from counters. Nil if there are no rules.
+	rates *rateDeriver
+
+	// Regexps of file paths for metricDir sources.
+	metricDirSourceRegexp []*regexp.Regexp
+
+	// Backends with settings by address.
+	backends map[string]*Backend
+
+	// Rules to convert InfluxDB line protocol to Graphite.
+	influxConverter *influxConverter
+
+	// Rules to convert Prometheus series to Graphite.
+	promConverter *promConverter
+
+	// Rules to convert OpenTelemetry metrics to Graphite.
+	otlpConverter *otlpConverter
+
 	// Main channel.
 	mainChannel chan string
 
 	// Aggregation channel.
-	aggrChannel chan string
+	aggrChannel chan Metric
+
+	// Partial aggregation state of the current interval.
+	aggregator *aggregator
+
+	// Client to forward partial aggregations. Nil if AggrForward is not set.
+	aggrForwarder *http.Client
+
+	// Queue of partial aggregations to forward. Nil if AggrForward is not set.
+	aggrForwardChannel chan *aggrState
 
 	// Monitoring channel.
 	monitoringChannel chan string
@@ -163,6 +555,205 @@ func (conf *Config) LoadConfig(configFile string) error {
 		conf.RetryKeepSecs = conf.ClientSendInterval * 10
 	}
 
+	for _, pattern := range conf.MetricDirIgnore {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern in MetricDirIgnore '%s': %s", pattern, err)
+		}
+	}
+
+	if conf.InfluxTemplate == "" {
+		conf.InfluxTemplate = defaultInfluxTemplate
+	}
+
+	if conf.PromTemplate == "" {
+		conf.PromTemplate = defaultPromTemplate
+	}
+
+	if conf.OTLPTemplate == "" {
+		conf.OTLPTemplate = defaultOTLPTemplate
+	}
+	if conf.OTLPPercentiles == nil {
+		conf.OTLPPercentiles = defaultOTLPPercentiles
+	}
+	for _, p := range conf.OTLPPercentiles {
+		if p <= 0 || p > 100 {
+			return errors.New("OTLPPercentiles must be in range (0, 100]")
+		}
+	}
+
+	if conf.AggrStateInterval <= 0 {
+		conf.AggrStateInterval = defaultAggrStateInterval
+	}
+
+	if conf.AggrGrace <= 0 {
+		conf.AggrGrace = defaultAggrGrace
+	}
+
+	if conf.TimerPercentiles == nil {
+		conf.TimerPercentiles = defaultTimerPercentiles
+	}
+	for _, p := range conf.TimerPercentiles {
+		if p <= 0 || p > 100 {
+			return errors.New("TimerPercentiles must be in range (0, 100]")
+		}
+	}
+	sort.Float64s(conf.TimerBuckets)
+
+	for i := range conf.Scrape {
+		if conf.Scrape[i].URL == "" {
+			return errors.New("URL of scrape target must be set")
+		}
+		if conf.Scrape[i].Interval <= 0 {
+			conf.Scrape[i].Interval = conf.ClientSendInterval
+		}
+		if conf.Scrape[i].Timeout <= 0 {
+			conf.Scrape[i].Timeout = conf.ConnectTimeout
+		}
+	}
+
+	for i := range conf.Backend {
+		b := &conf.Backend[i]
+		if b.Addr == "" {
+			return errors.New("Addr of backend must be set")
+		}
+		if b.Type == "" {
+			b.Type = backendTCP
+		}
+		if b.Type != backendTCP && b.Type != backendHTTP && b.Type != backendPrometheus {
+			return errors.New("Type of backend " + b.Addr + " must be tcp, http or prometheus")
+		}
+		if b.Format == "" {
+			b.Format = backendFormatGraphite
+		}
+		if b.Format != backendFormatGraphite && b.Format != backendFormatInflux {
+			return errors.New("Format of backend " + b.Addr + " must be graphite or influx")
+		}
+		if b.BatchSize <= 0 {
+			b.BatchSize = defaultBackendBatchSize
+		}
+		if b.Template == "" {
+			b.Template = defaultBackendPromTemplate
+		}
+
+		found := false
+		for _, carbonAddr := range conf.CarbonAddrs {
+			found = found || carbonAddr == b.Addr
+		}
+		if !found {
+			conf.CarbonAddrs = append(conf.CarbonAddrs, b.Addr)
+		}
+	}
+
+	overwriteNames := make(map[string]bool)
+	for i := range conf.Overwrite {
+		rule := &conf.Overwrite[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule_%d", i+1)
+		}
+		rule.Name = strings.Replace(rule.Name, ".", "_", -1)
+		if overwriteNames[rule.Name] {
+			return errors.New("Name of overwrite rule " + rule.Name + " is not unique")
+		}
+		overwriteNames[rule.Name] = true
+		if rule.Action == "" {
+			rule.Action = overwriteReplace
+		}
+		if rule.Action != overwriteReplace && rule.Action != overwriteLower &&
+			rule.Action != overwriteUpper && rule.Action != overwriteSanitize {
+			return errors.New("Action of overwrite rule " + rule.Name + " must be replace, lower, upper or sanitize")
+		}
+		if rule.Action == overwriteSanitize && rule.ReplaceWith == "" {
+			rule.ReplaceWith = "_"
+		}
+		if rule.Continue && rule.Last {
+			return errors.New("Overwrite rule " + rule.Name + " can not have both continue and last")
+		}
+	}
+
+	filterNames := make(map[string]bool)
+	for i := range conf.Filter {
+		rule := &conf.Filter[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule_%d", i+1)
+		}
+		rule.Name = strings.Replace(rule.Name, ".", "_", -1)
+		if filterNames[rule.Name] {
+			return errors.New("Name of filter rule " + rule.Name + " is not unique")
+		}
+		filterNames[rule.Name] = true
+		if rule.Action != filterAllow && rule.Action != filterDeny {
+			return errors.New("Action of filter rule " + rule.Name + " must be allow or deny")
+		}
+		if rule.Regexp == "" && len(rule.Prefixes) == 0 {
+			return errors.New("Filter rule " + rule.Name + " must have regexp or prefixes")
+		}
+		if _, err := regexp.Compile(rule.Regexp); err != nil {
+			return fmt.Errorf("invalid regexp of filter rule %s: %s", rule.Name, err)
+		}
+	}
+
+	if conf.CardinalityTopN <= 0 {
+		conf.CardinalityTopN = defaultCardinalityTopN
+	}
+
+	if conf.SanitizeMaxNodeLength <= 0 {
+		conf.SanitizeMaxNodeLength = defaultSanitizeMaxNodeLength
+	}
+
+	if conf.SanitizeChars == "" {
+		conf.SanitizeChars = defaultSanitizeChars
+	}
+	if re, err := regexp.Compile("[^" + conf.SanitizeChars + "]"); err != nil {
+		return fmt.Errorf("invalid SanitizeChars '%s': %s", conf.SanitizeChars, err)
+	} else if !re.MatchString(" ") || !re.MatchString(";") {
+		return errors.New("SanitizeChars must not allow whitespaces and ;")
+	}
+
+	if conf.InvalidLogSample <= 0 {
+		conf.InvalidLogSample = 1
+	}
+
+	for i := range conf.Downsample {
+		rule := &conf.Downsample[i]
+		if _, err := regexp.Compile(rule.Regexp); err != nil {
+			return fmt.Errorf("invalid regexp of downsample rule '%s': %s", rule.Regexp, err)
+		}
+		if rule.Window <= 0 {
+			rule.Window = defaultDownsampleWindow
+		}
+		if rule.Function == "" {
+			rule.Function = downsampleLast
+		}
+		if rule.Function != downsampleLast && rule.Function != downsampleAvg &&
+			rule.Function != downsampleMin && rule.Function != downsampleMax {
+			return errors.New("Function of downsample rule must be last, avg, min or max")
+		}
+	}
+
+	for i := range conf.Rate {
+		rule := &conf.Rate[i]
+		if _, err := regexp.Compile(rule.Regexp); err != nil {
+			return fmt.Errorf("invalid regexp of rate rule '%s': %s", rule.Regexp, err)
+		}
+		if rule.Output == "" {
+			rule.Output = defaultRateOutput
+		}
+	}
+	if conf.RateMaxGap <= 0 {
+		conf.RateMaxGap = defaultRateMaxGap
+	}
+
+	if conf.Dedup != "" && conf.Dedup != dedupFirst && conf.Dedup != dedupLast {
+		return errors.New("Dedup must be first or last")
+	}
+
+	if conf.TimestampOutOfWindow == "" {
+		conf.TimestampOutOfWindow = timestampReject
+	}
+	if conf.TimestampOutOfWindow != timestampReject && conf.TimestampOutOfWindow != timestampClamp {
+		return errors.New("TimestampOutOfWindow must be reject or clamp")
+	}
+
 	if conf.MonitoringPath == "" {
 		// This will be replaced later by monitoring routine
 		conf.MonitoringPath = "HOSTNAME"
@@ -184,6 +775,12 @@ func (conf *Config) prepareEnvironment() error {
 		os.Chmod(conf.MetricDir, 0777|os.ModeSticky)
 	}
 
+	if conf.QuarantineDir != "" {
+		if err := os.MkdirAll(conf.QuarantineDir, 0750); err != nil {
+			return errors.Wrap(err, "Can not create quarantineDir "+conf.QuarantineDir)
+		}
+	}
+
 	/*
 		Unfortunately some people write to MetricDir with random permissions.
 		To avoid server crashing and overflowing we need to set ACL on MetricDir, that grafsy is allowed
@@ -202,8 +799,34 @@ func (conf *Config) prepareEnvironment() error {
 		}
 	}
 
+	// Check if URLs of HTTP and Prometheus backends are valid
+	httpBackends := make(map[string]bool)
+	for _, b := range conf.Backend {
+		if b.Type == backendTCP {
+			continue
+		}
+		u, err := url.Parse(b.Addr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Invalid URL of HTTP backend: " + b.Addr)
+		}
+		httpBackends[b.Addr] = true
+	}
+
+	if conf.AggrForward != "" {
+		u, err := url.Parse(conf.AggrForward)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Invalid URL of AggrForward: " + conf.AggrForward)
+		}
+	}
+	if conf.AggrCentral && conf.HTTPBind == "" {
+		return errors.New("AggrCentral requires HTTPBind")
+	}
+
 	// Check if servers in CarbonAddrs are resolvable
 	for _, carbonAddr := range conf.CarbonAddrs {
+		if httpBackends[carbonAddr] {
+			continue
+		}
 		_, err := net.ResolveTCPAddr("tcp", carbonAddr)
 		if err != nil {
 			return errors.New("Could not resolve an address from CarbonAddrs: " + err.Error())
@@ -213,6 +836,42 @@ func (conf *Config) prepareEnvironment() error {
 	return nil
 }
 
+func (conf *Config) generateRegexpsForMetricDirSource() []*regexp.Regexp {
+	sourceRegexp := make([]*regexp.Regexp, len(conf.MetricDirSource))
+	for i := range conf.MetricDirSource {
+		sourceRegexp[i] = regexp.MustCompile(conf.MetricDirSource[i].PathRegexp)
+	}
+	return sourceRegexp
+}
+
+// ResolveHostname returns Hostname from the config or os.Hostname() result with dots replaced by underscores.
+func (conf *Config) ResolveHostname() (string, error) {
+	if conf.Hostname != "" {
+		return conf.Hostname, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", errors.New("Can not resolve the hostname: " + err.Error())
+	}
+	return strings.Replace(hostname, ".", "_", -1), nil
+}
+
+// Compile regexp if it is set
+func compileOptionalRegexp(expr string) *regexp.Regexp {
+	if expr == "" {
+		return nil
+	}
+	return regexp.MustCompile(expr)
+}
+
+func (conf *Config) generateBackends() map[string]*Backend {
+	backends := make(map[string]*Backend, len(conf.Backend))
+	for i := range conf.Backend {
+		backends[conf.Backend[i].Addr] = &conf.Backend[i]
+	}
+	return backends
+}
+
 func (conf *Config) generateRegexpsForOverwrite() []*regexp.Regexp {
 	overwriteMetric := make([]*regexp.Regexp, len(conf.Overwrite))
 	for i := range conf.Overwrite {
@@ -259,17 +918,30 @@ func (conf *Config) GenerateLocalConfig() (*LocalConfig, error) {
 	}
 	lg := log.New(f, "", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 
-	hostname := conf.Hostname
-	if hostname == "" {
-		hostname, err = os.Hostname()
-		if err != nil {
-			return nil, errors.New("Can not resolve the hostname: " + err.Error())
-		}
-		hostname = strings.Replace(hostname, ".", "_", -1)
+	hostname, err := conf.ResolveHostname()
+	if err != nil {
+		return nil, err
 	}
 
-	// There are 4 metrics per backend in client and 3 in server stats
-	MonitorMetrics := 3 + len(conf.CarbonAddrs)*5
+	// There are 5 metrics per backend in client and 30 in server stats
+	MonitorMetrics := 30 + len(conf.CarbonAddrs)*5
+	// And 1 metric per filter and overwrite rule
+	MonitorMetrics += len(conf.Filter) + len(conf.Overwrite)
+	if conf.CardinalityPrefixDepth > 0 {
+		// And 2 metrics per top prefix
+		MonitorMetrics += conf.CardinalityTopN * 2
+	}
+	if conf.generateLimiter() != nil {
+		// And 2 metrics per limited prefix
+		MonitorMetrics += maxLimitPrefixes * 2
+	}
+	// And 2 metrics per source of metricDir
+	MonitorMetrics += conf.dirSourceNames() * 2
+
+	aggrPrefixes := []string{conf.AvgPrefix, conf.SumPrefix, conf.MinPrefix, conf.MaxPrefix}
+	if conf.TimerPrefix != "" {
+		aggrPrefixes = append(aggrPrefixes, conf.TimerPrefix)
+	}
 
 	return &LocalConfig{
 		hostname:       hostname,
@@ -278,13 +950,38 @@ func (conf *Config) GenerateLocalConfig() (*LocalConfig, error) {
 		/*
 			Retry file will take only 10 full buffers
 		*/
-		fileMetricSize:    conf.MetricsPerSecond * conf.RetryKeepSecs,
-		lg:                lg,
-		allowedMetrics:    regexp.MustCompile(conf.AllowedMetrics),
-		aggrRegexp:        regexp.MustCompile(fmt.Sprintf("^(%s|%s|%s|%s)..*", conf.AvgPrefix, conf.SumPrefix, conf.MinPrefix, conf.MaxPrefix)),
-		overwriteRegexp:   conf.generateRegexpsForOverwrite(),
-		mainChannel:       make(chan string, mainBuffSize+MonitorMetrics),
-		aggrChannel:       make(chan string, aggrBuffSize),
-		monitoringChannel: make(chan string, MonitorMetrics),
+		fileMetricSize:        conf.MetricsPerSecond * conf.RetryKeepSecs,
+		lg:                    lg,
+		allowedMetrics:        compileOptionalRegexp(conf.AllowedMetrics),
+		allowedNames:          compileOptionalRegexp(conf.AllowedNames),
+		sanitizeRegexp:        regexp.MustCompile("[^" + conf.SanitizeChars + "]"),
+		filters:               conf.generateFilters(),
+		limiter:               conf.generateLimiter(),
+		cardinality:           conf.generateCardinalityTracker(),
+		downsampler:           conf.generateDownsampler(),
+		rates:                 conf.generateRateDeriver(),
+		aggrRegexp:            regexp.MustCompile(fmt.Sprintf("^(%s)..*", strings.Join(aggrPrefixes, "|"))),
+		overwriteRegexp:       conf.generateRegexpsForOverwrite(),
+		metricDirSourceRegexp: conf.generateRegexpsForMetricDirSource(),
+		backends:              conf.generateBackends(),
+		influxConverter: &influxConverter{
+			template: parsePathTemplate(conf.InfluxTemplate),
+			dropTags: conf.InfluxDropTags,
+		},
+		promConverter: &promConverter{
+			template: parsePathTemplate(conf.PromTemplate),
+			dropTags: conf.PromDropTags,
+		},
+		otlpConverter: &otlpConverter{
+			template:    parsePathTemplate(conf.OTLPTemplate),
+			dropTags:    conf.OTLPDropTags,
+			percentiles: conf.OTLPPercentiles,
+		},
+		mainChannel:        make(chan string, mainBuffSize+MonitorMetrics),
+		aggrChannel:        make(chan Metric, aggrBuffSize),
+		aggregator:         conf.generateAggregator(),
+		aggrForwarder:      conf.generateAggrForwarder(),
+		aggrForwardChannel: conf.generateAggrForwardChannel(),
+		monitoringChannel:  make(chan string, MonitorMetrics),
 	}, nil
 }
@@ -0,0 +1,78 @@
+package grafsy
+
+import "strings"
+
+// Policies of deduplication
+const (
+	dedupFirst = "first"
+	dedupLast  = "last"
+)
+
+// Deduplicator of points with the same name and timestamp.
+// Points are sent every second, so only keys of points are kept for the whole send interval.
+type deduplicator struct {
+	// Replace the value of the point with the value of its duplicate.
+	// Duplicates with another value received in later seconds are sent again, because the last value overwrites the previous one in carbon.
+	lastWins bool
+
+	// Values of points sent within the current send interval by name and timestamp.
+	seen map[string]string
+
+	// Position of points in pending by name and timestamp.
+	index map[string]int
+
+	// Points of the current second in the order of receiving.
+	pending []string
+}
+
+// Create deduplicator from config. Return nil if deduplication is disabled.
+func (conf *Config) generateDeduplicator() *deduplicator {
+	if conf.Dedup == "" {
+		return nil
+	}
+	return &deduplicator{
+		lastWins: conf.Dedup == dedupLast,
+		seen:     make(map[string]string),
+		index:    make(map[string]int),
+	}
+}
+
+// Add metric in format <name> <value> <timestamp>.
+// Return false if it is a duplicate of already added point.
+// With lastWins a duplicate with another value of the point sent in the previous seconds is still sent.
+func (d *deduplicator) add(metric string) bool {
+	fields := strings.Fields(metric)
+	if len(fields) != 3 {
+		d.pending = append(d.pending, metric)
+		return true
+	}
+	key, value := fields[0]+" "+fields[2], fields[1]
+	if i, ok := d.index[key]; ok {
+		if d.lastWins {
+			d.pending[i] = metric
+			d.seen[key] = value
+		}
+		return false
+	}
+	sent, duplicate := d.seen[key]
+	if duplicate && (!d.lastWins || sent == value) {
+		return false
+	}
+	d.seen[key] = value
+	d.index[key] = len(d.pending)
+	d.pending = append(d.pending, metric)
+	return !duplicate
+}
+
+// Get unique points of the current second
+func (d *deduplicator) flush() []string {
+	pending := d.pending
+	d.pending = nil
+	d.index = make(map[string]int, len(d.index))
+	return pending
+}
+
+// Forget points of the send interval
+func (d *deduplicator) reset() {
+	d.seen = make(map[string]string, len(d.seen))
+}
@@ -0,0 +1,107 @@
+package grafsy
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Maximum amount of metricDir sources reported per monitoring interval.
+// Statistic of the rest is reported under otherDirSource.
+const maxDirSources = 100
+
+// Name of the source for statistic which does not fit into maxDirSources.
+const otherDirSource = "other"
+
+// The statistic of metrics per source of metricDir
+type dirSourceStat struct {
+	// Amount of metrics from source.
+	got int
+
+	// Amount of invalid metrics from source.
+	invalid int
+}
+
+// The source of metrics in file of metricDir
+type dirSource struct {
+	// Name of the source in self-monitoring.
+	name string
+
+	// Prefix for every metric.
+	prefix string
+
+	// Graphite tags for every metric in format ;tag1=value1;tag2=value2
+	tags string
+}
+
+// Get maximum amount of sources reported in self-monitoring.
+// Names of sources with references to submatches are not known in advance, so maxDirSources is used for them.
+func (conf *Config) dirSourceNames() int {
+	names := make(map[string]bool)
+	for _, rule := range conf.MetricDirSource {
+		name := rule.Name
+		if name == "" {
+			name = rule.Prefix
+		}
+		if strings.Contains(name, "$") {
+			return maxDirSources
+		}
+		names[name] = true
+	}
+	if len(names) > maxDirSources {
+		return maxDirSources
+	}
+	return len(names)
+}
+
+// Find the source of file by its path relative to metricDir.
+// Return nil if there is no matching source.
+func (s Server) metricDirSource(file string) *dirSource {
+	file = filepath.ToSlash(file)
+	for i, re := range s.Lc.metricDirSourceRegexp {
+		match := re.FindStringSubmatchIndex(file)
+		if match == nil {
+			continue
+		}
+		rule := s.Conf.MetricDirSource[i]
+		expand := func(template string) string {
+			return string(re.ExpandString(nil, template, file, match))
+		}
+
+		src := &dirSource{
+			name:   expand(rule.Name),
+			prefix: expand(rule.Prefix),
+		}
+		if src.name == "" {
+			src.name = strings.Trim(src.prefix, ".")
+		}
+		// Name is a single node of monitoring path
+		src.name = sanitizeChars(strings.Replace(src.name, ".", "_", -1), "_")
+		if src.name == "" {
+			src.name = otherDirSource
+		}
+
+		tagNames := make([]string, 0, len(rule.Tags))
+		for tag := range rule.Tags {
+			tagNames = append(tagNames, tag)
+		}
+		sort.Strings(tagNames)
+		for _, tag := range tagNames {
+			src.tags += ";" + tag + "=" + graphiteTagSafe(expand(rule.Tags[tag]))
+		}
+		return src
+	}
+	return nil
+}
+
+// Add prefix and tags of the source to metric in format <name> <value> <timestamp>
+func (src *dirSource) apply(metric string) string {
+	if metric == "" {
+		return metric
+	}
+	i := strings.IndexAny(metric, " \t")
+	if i < 0 {
+		return src.prefix + metric + src.tags
+	}
+	return src.prefix + metric[:i] + src.tags + metric[i:]
+}
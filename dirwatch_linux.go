@@ -0,0 +1,122 @@
+package grafsy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Inotify watch descriptors and related directories relative to metricDir
+type dirWatcher struct {
+	fd   int
+	dirs map[int32]string
+}
+
+// Add inotify watch for the directory relative to metricDir.
+// With recursive metricDir all subdirectories are watched as well.
+func (s Server) addDirWatch(w *dirWatcher, dir string) error {
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO)
+	if s.Conf.MetricDirRecursive {
+		mask |= syscall.IN_CREATE
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, filepath.Join(s.Conf.MetricDir, dir), mask)
+	if err != nil {
+		return errors.Wrap(err, "Can not add inotify watch for "+filepath.Join(s.Conf.MetricDir, dir))
+	}
+	w.dirs[int32(wd)] = dir
+
+	if !s.Conf.MetricDirRecursive {
+		return nil
+	}
+	entries, _ := os.ReadDir(filepath.Join(s.Conf.MetricDir, dir))
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if entry.IsDir() && !s.ignoredMetricFile(name) {
+			if err = s.addDirWatch(w, name); err != nil {
+				s.Lc.lg.Println(err.Error())
+				s.Mon.Increase(&s.Mon.serverStat.unreadable, 1)
+			}
+		}
+	}
+	return nil
+}
+
+// Watch metricDir with inotify and read files as soon as producers finish writing them.
+// Files, which are closed after writing or moved into metricDir, are consumed.
+// It returns only if inotify can not be used anymore.
+func (s Server) watchDirMetrics() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return errors.Wrap(err, "Can not initialize inotify")
+	}
+	defer syscall.Close(fd)
+
+	w := &dirWatcher{fd: fd, dirs: make(map[int32]string)}
+	if err = s.addDirWatch(w, ""); err != nil {
+		return err
+	}
+	s.Lc.lg.Println("Watching metricDir with inotify")
+
+	// Files, which were written before the watch was added
+	s.readDirMetrics("")
+
+	buf := make([]byte, 4096*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "Can not read inotify events")
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Some events are lost, so we have to check the whole directory
+				s.Lc.lg.Println("Inotify queue overflow, rereading metricDir")
+				s.readDirMetrics("")
+				continue
+			}
+			dir, ok := w.dirs[event.Wd]
+			if !ok {
+				continue
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				if dir == "" {
+					return errors.New("Inotify watch for " + s.Conf.MetricDir + " was removed")
+				}
+				delete(w.dirs, event.Wd)
+				continue
+			}
+			if event.Len == 0 {
+				continue
+			}
+
+			name := filepath.Join(dir, string(bytes.TrimRight(buf[nameStart:offset], "\x00")))
+			if event.Mask&syscall.IN_ISDIR != 0 {
+				if s.Conf.MetricDirRecursive && !s.ignoredMetricFile(name) {
+					if err = s.addDirWatch(w, name); err != nil {
+						s.Lc.lg.Println(err.Error())
+						s.Mon.Increase(&s.Mon.serverStat.unreadable, 1)
+					}
+					// Files, which were written before the watch was added
+					s.readDirMetrics(name)
+				}
+				continue
+			}
+			if event.Mask&syscall.IN_CREATE != 0 {
+				// File is not written yet
+				continue
+			}
+			s.handleMetricFile(name)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package grafsy
+
+import "github.com/pkg/errors"
+
+// Inotify is available only on Linux
+func (s Server) watchDirMetrics() error {
+	return errors.New("inotify is supported only on Linux")
+}
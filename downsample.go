@@ -0,0 +1,187 @@
+package grafsy
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Functions of downsampling
+const (
+	downsampleLast = "last"
+	downsampleAvg  = "avg"
+	downsampleMin  = "min"
+	downsampleMax  = "max"
+)
+
+// Default window of downsampling. In seconds.
+const defaultDownsampleWindow = 60
+
+// Results of adding a point to downsampler
+const (
+	downsamplePassed = iota
+	downsampleConsumed
+	downsampleTooLate
+)
+
+// Compiled downsampling rule
+type downsampleRule struct {
+	re       *regexp.Regexp
+	window   int64
+	function string
+}
+
+// Series and beginning of its window
+type downsampleKey struct {
+	name  string
+	start int64
+}
+
+// Points of a series in a single window
+type downsampleWindow struct {
+	metricData
+
+	rule *downsampleRule
+
+	// Timestamp of the value for "last" function.
+	timestamp int64
+}
+
+// Downsampler keeps a single point per series per window for metrics matching rules
+type downsampler struct {
+	mu    sync.Mutex
+	rules []*downsampleRule
+
+	// Maximum amount of windows in memory. Metrics over the limit are not downsampled.
+	maxWindows int
+
+	// Windows by name of series and beginning of the window.
+	windows map[downsampleKey]*downsampleWindow
+
+	// Flushed windows and time until points of them are rejected as late.
+	// A late point must not start a new window, which would overwrite the flushed point in carbon.
+	flushed map[downsampleKey]int64
+}
+
+// Create downsampler from config. Return nil if there are no rules.
+func (conf *Config) generateDownsampler() *downsampler {
+	if len(conf.Downsample) == 0 {
+		return nil
+	}
+	d := &downsampler{
+		maxWindows: conf.AggrPerSecond * conf.AggrInterval,
+		windows:    make(map[downsampleKey]*downsampleWindow),
+		flushed:    make(map[downsampleKey]int64),
+	}
+	for _, rule := range conf.Downsample {
+		d.rules = append(d.rules, &downsampleRule{
+			re:       regexp.MustCompile(rule.Regexp),
+			window:   int64(rule.Window),
+			function: rule.Function,
+		})
+	}
+	return d
+}
+
+// Add metric to the window of its series if it matches any rule.
+// Return downsamplePassed if metric must be sent as is and downsampleTooLate if its window was already flushed.
+func (d *downsampler) add(m Metric) int {
+	var rule *downsampleRule
+	for _, r := range d.rules {
+		if r.re.MatchString(m.Path) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		return downsamplePassed
+	}
+	key := downsampleKey{name: m.Name(), start: m.Timestamp - m.Timestamp%rule.window}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.flushed[key]; ok {
+		return downsampleTooLate
+	}
+	w, ok := d.windows[key]
+	if !ok {
+		if len(d.windows) >= d.maxWindows {
+			return downsamplePassed
+		}
+		d.windows[key] = &downsampleWindow{
+			metricData: metricData{value: m.Value, amount: 1},
+			rule:       rule,
+			timestamp:  m.Timestamp,
+		}
+		return downsampleConsumed
+	}
+
+	switch rule.function {
+	case downsampleAvg:
+		w.value += m.Value
+	case downsampleMin:
+		if m.Value < w.value {
+			w.value = m.Value
+		}
+	case downsampleMax:
+		if m.Value > w.value {
+			w.value = m.Value
+		}
+	default:
+		if m.Timestamp >= w.timestamp {
+			w.value = m.Value
+			w.timestamp = m.Timestamp
+		}
+	}
+	w.amount++
+	return downsampleConsumed
+}
+
+// Remove windows, which ended before now, and return their points with timestamps of window beginnings.
+// Flushed windows are remembered for the length of the window.
+func (d *downsampler) flush(now int64) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, until := range d.flushed {
+		if until <= now {
+			delete(d.flushed, key)
+		}
+	}
+
+	var result []string
+	for key, w := range d.windows {
+		if key.start+w.rule.window > now {
+			continue
+		}
+		value := w.value
+		if w.rule.function == downsampleAvg {
+			value /= float64(w.amount)
+		}
+		formatted, _ := formatGraphiteValue(value)
+		result = append(result, fmt.Sprintf("%s %s %d", key.name, formatted, key.start))
+		delete(d.windows, key)
+		d.flushed[key] = key.start + 2*w.rule.window
+	}
+	return result
+}
+
+// Send downsampled points of ended windows every second
+func (s Server) downsampleMetrics() {
+	for ; ; time.Sleep(time.Second) {
+		dropped := 0
+		for _, metric := range s.Lc.downsampler.flush(time.Now().Unix()) {
+			select {
+			case s.Lc.mainChannel <- metric:
+			default:
+				s.Lc.lg.Printf("Too many metrics in the main queue (%d). I can not append downsampled metrics", len(s.Lc.mainChannel))
+				dropped++
+			}
+		}
+		if dropped > 0 {
+			for _, carbonAddr := range s.Conf.CarbonAddrs {
+				s.Mon.Increase(&s.Mon.clientStat[carbonAddr].dropped, dropped)
+			}
+		}
+	}
+}
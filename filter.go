@@ -0,0 +1,115 @@
+package grafsy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Actions of filter rules
+const (
+	filterAllow = "allow"
+	filterDeny  = "deny"
+)
+
+// Trie of Graphite path prefixes by nodes, e.g. "a.b" matches "a.b" and "a.b.c", but not "a.bc"
+type prefixTrie struct {
+	children map[string]*prefixTrie
+
+	// The prefix ends at this node
+	terminal bool
+}
+
+// Add prefix to the trie
+func (t *prefixTrie) add(prefix string) {
+	node := t
+	for _, part := range strings.Split(strings.Trim(prefix, "."), ".") {
+		if node.children == nil {
+			node.children = make(map[string]*prefixTrie)
+		}
+		child, ok := node.children[part]
+		if !ok {
+			child = &prefixTrie{}
+			node.children[part] = child
+		}
+		node = child
+	}
+	node.terminal = true
+}
+
+// Check if any prefix of the trie matches the path
+func (t *prefixTrie) match(path string) bool {
+	node := t
+	for {
+		if node.terminal {
+			return true
+		}
+		part := path
+		i := strings.IndexByte(path, '.')
+		if i >= 0 {
+			part = path[:i]
+		}
+		child, ok := node.children[part]
+		if !ok {
+			return false
+		}
+		node = child
+		if i < 0 {
+			return node.terminal
+		}
+		path = path[i+1:]
+	}
+}
+
+// Compiled filter rule
+type filterRule struct {
+	// Name of the rule in self-monitoring.
+	name string
+
+	// Deny or allow matching metrics.
+	deny bool
+
+	// Regexp of metric path. Nil if not set.
+	re *regexp.Regexp
+
+	// Prefixes of metric path. Nil if not set.
+	prefixes *prefixTrie
+}
+
+// Check if the rule matches metric path
+func (r *filterRule) match(path string) bool {
+	if r.re != nil && r.re.MatchString(path) {
+		return true
+	}
+	return r.prefixes != nil && r.prefixes.match(path)
+}
+
+// Compile filter rules from config
+func (conf *Config) generateFilters() []*filterRule {
+	filters := make([]*filterRule, len(conf.Filter))
+	for i, rule := range conf.Filter {
+		filters[i] = &filterRule{
+			name: rule.Name,
+			deny: rule.Action == filterDeny,
+			re:   compileOptionalRegexp(rule.Regexp),
+		}
+		if len(rule.Prefixes) > 0 {
+			filters[i].prefixes = &prefixTrie{}
+			for _, prefix := range rule.Prefixes {
+				filters[i].prefixes.add(prefix)
+			}
+		}
+	}
+	return filters
+}
+
+// Evaluate filter rules in order and count the hit of the first matching rule.
+// Return false if metric is denied.
+func (s Server) filterMetric(m Metric) bool {
+	for _, rule := range s.Lc.filters {
+		if rule.match(m.Path) {
+			s.Mon.increaseFilter(rule.name)
+			return !rule.deny
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package grafsy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Formats of metric files
+const (
+	// Graphite plaintext protocol, one metric per line
+	formatPlain = iota
+
+	// JSON array of objects: [{"name": ..., "value": ..., "ts": ...}]
+	formatJSON
+
+	// InfluxDB line protocol
+	formatInflux
+)
+
+// A single metric in JSON format
+type jsonMetric struct {
+	Name  string            `json:"name"`
+	Value json.Number       `json:"value"`
+	TS    json.Number       `json:"ts"`
+	Tags  map[string]string `json:"tags"`
+}
+
+// Detect the format of file by its extension or, if it is not known, by the first byte.
+func detectFileFormat(name string, r *bufio.Reader) int {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return formatJSON
+	case ".influx", ".lp":
+		return formatInflux
+	case ".txt", ".graphite":
+		return formatPlain
+	}
+
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return formatPlain
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+			continue
+		case '[', '{':
+			return formatJSON
+		}
+		return formatPlain
+	}
+}
+
+// Convert JSON metric to the Graphite plaintext format
+func (m *jsonMetric) graphiteMetric() (string, error) {
+	if m.Name == "" {
+		return "", errors.New("metric without name")
+	}
+	if _, err := m.Value.Float64(); err != nil {
+		return "", errors.New("invalid value of metric " + m.Name)
+	}
+
+	metric := m.Name
+	tagNames := make([]string, 0, len(m.Tags))
+	for tag := range m.Tags {
+		tagNames = append(tagNames, tag)
+	}
+	sort.Strings(tagNames)
+	for _, tag := range tagNames {
+		metric += ";" + graphiteSafe(tag) + "=" + graphiteTagSafe(m.Tags[tag])
+	}
+	metric += " " + m.Value.String()
+
+	if m.TS != "" {
+		ts, err := m.TS.Float64()
+		if err != nil {
+			return "", errors.New("invalid timestamp of metric " + m.Name)
+		}
+		metric += " " + strconv.FormatInt(int64(ts), 10)
+	} else {
+		// Metric without timestamp is received now
+		metric += " " + strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	return metric, nil
+}
+
+// Read metrics in JSON format.
+// Both array of metrics and a single metric object are accepted.
+// Return converted metrics and amount of metrics which can not be converted.
+func readJSONMetrics(r io.Reader) ([]string, int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var jsonMetrics []jsonMetric
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "{") {
+		jsonMetrics = make([]jsonMetric, 1)
+		err = json.Unmarshal([]byte(trimmed), &jsonMetrics[0])
+	} else {
+		err = json.Unmarshal([]byte(trimmed), &jsonMetrics)
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Can not parse JSON")
+	}
+
+	metrics := make([]string, 0, len(jsonMetrics))
+	invalid := 0
+	for i := range jsonMetrics {
+		metric, err := jsonMetrics[i].graphiteMetric()
+		if err != nil {
+			invalid++
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, invalid, nil
+}
+
+// Read metrics from reader in the detected format and convert them to Graphite plaintext format.
+// Return converted metrics, amount of metrics which can not be converted and read error.
+func readMetricsInFormat(name string, r io.Reader, influx *influxConverter) ([]string, int, error) {
+	br := bufio.NewReader(r)
+	return readMetricsOfFormat(detectFileFormat(name, br), br, influx)
+}
+
+// Read metrics from reader in the given format and convert them to Graphite plaintext format.
+// Return converted metrics, amount of metrics which can not be converted and read error.
+func readMetricsOfFormat(format int, r io.Reader, influx *influxConverter) ([]string, int, error) {
+	switch format {
+	case formatJSON:
+		return readJSONMetrics(r)
+	case formatInflux:
+		lines, err := readLines(r)
+		metrics, invalid := influx.convertLines(lines)
+		return metrics, invalid, err
+	}
+	lines, err := readLines(r)
+	return lines, 0, err
+}
@@ -5,7 +5,9 @@ go 1.21.0
 toolchain go1.23.3
 
 require (
+	github.com/golang/snappy v1.0.0
 	github.com/naegelejd/go-acl v0.0.0-20200406162857-ebe394c522e5
 	github.com/pelletier/go-toml/v2 v2.2.3
 	github.com/pkg/errors v0.9.1
+	google.golang.org/protobuf v1.34.2
 )
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/leoleovich/grafsy"
+)
+
+var version = "dev"
+
+const timeFormat = "2006-01-02 15:04:05"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [args] list\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "   Or: %s [args] dump [-grep regexp] backend\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "   Or: %s [args] move from-backend to-backend\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "   Or: %s [args] replay [-rate N] [-w timeout] [-keep] backend carbon-address\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Inspects and recovers backlogs of grafsy retry files.")
+	fmt.Fprintln(os.Stderr, "It is recommended to stop grafsy before moving or replaying backlogs,")
+	fmt.Fprintln(os.Stderr, "otherwise the daemon may write to the same files concurrently.")
+	fmt.Fprintf(os.Stderr, "\nArgs:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var configFile, retryDir string
+	printVersion := false
+	flag.Usage = usage
+	flag.StringVar(&configFile, "c", grafsy.ConfigPath, "Path to config file.")
+	flag.StringVar(&retryDir, "d", "", "Path to retry directory. Overrides retryDir from config file.")
+	flag.BoolVar(&printVersion, "v", printVersion, "Print version and exit")
+	flag.Parse()
+
+	if printVersion {
+		fmt.Printf("Version: %v\n", version)
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var conf grafsy.Config
+	if retryDir == "" {
+		err := conf.LoadConfig(configFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		retryDir = conf.RetryDir
+	}
+
+	args := flag.Args()
+	switch args[0] {
+	case "list":
+		list(retryDir)
+	case "dump":
+		dump(retryDir, args[1:])
+	case "move":
+		move(retryDir, args[1:])
+	case "replay":
+		replay(&conf, retryDir, args[1:])
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// Print backends with size of backlog and time range
+func list(retryDir string) {
+	files, err := grafsy.ListRetryFiles(retryDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Printf("%-40s %10s %10s %-19s  %-19s\n", "BACKEND", "LINES", "INVALID", "OLDEST", "NEWEST")
+	for _, f := range files {
+		oldest, newest := "-", "-"
+		if !f.Oldest.IsZero() {
+			oldest = f.Oldest.Format(timeFormat)
+			newest = f.Newest.Format(timeFormat)
+		}
+		fmt.Printf("%-40s %10d %10d %-19s  %-19s\n", f.Backend, f.Lines, f.Invalid, oldest, newest)
+	}
+}
+
+// Print metrics of the backend, optionally filtered by regexp
+func dump(retryDir string, args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	grep := fs.String("grep", "", "Print only metrics matching this regexp")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var re *regexp.Regexp
+	if *grep != "" {
+		var err error
+		re, err = regexp.Compile(*grep)
+		if err != nil {
+			log.Fatalf("Invalid regexp: %v\n", err)
+		}
+	}
+
+	f, err := os.Open(path.Join(retryDir, grafsy.RetryFileName(fs.Arg(0))))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if re == nil || re.MatchString(scanner.Text()) {
+			fmt.Fprintln(out, scanner.Text())
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Move backlog from one backend to another
+func move(retryDir string, args []string) {
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	err := grafsy.MoveRetryFile(retryDir, args[0], args[1])
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Send backlog of the backend to carbon address with a limited rate.
+// Metrics which were not sent are kept in the retry file.
+func replay(conf *grafsy.Config, retryDir string, args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	rate := fs.Int("rate", 1000, "Maximum amount of metrics sent per second")
+	timeout := fs.Int("w", 5, "Timeout for connecting and writing. In seconds")
+	keep := fs.Bool("keep", false, "Do not remove sent metrics from the retry file")
+	fs.Parse(args)
+	if fs.NArg() != 2 || *rate < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	retFile := path.Join(retryDir, grafsy.RetryFileName(fs.Arg(0)))
+	carbonAddr := fs.Arg(1)
+
+	hostname, err := conf.ResolveHostname()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	metrics, err := grafsy.ReadRetryFile(retFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	conn, err := net.DialTimeout("tcp", carbonAddr, time.Duration(*timeout)*time.Second)
+	if err != nil {
+		log.Fatalf("Fail to establish connection: %v\n", err)
+	}
+	defer conn.Close()
+
+	sent := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for sent < len(metrics) {
+		end := sent + *rate
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(time.Duration(*timeout) * time.Second))
+		w := bufio.NewWriter(conn)
+		for _, metric := range metrics[sent:end] {
+			// The same as grafsy does: "HOSTNAME" is replaced with real hostname
+			w.WriteString(strings.Replace(metric, "HOSTNAME", hostname, -1) + "\n")
+		}
+		if err = w.Flush(); err != nil {
+			log.Printf("Write to server failed after %d metrics: %v\n", sent, err)
+			break
+		}
+		sent = end
+		log.Printf("Sent %d/%d metrics\n", sent, len(metrics))
+
+		if sent < len(metrics) {
+			<-ticker.C
+		}
+	}
+
+	if !*keep {
+		if err := grafsy.WriteRetryFile(retFile, metrics[sent:]); err != nil {
+			log.Fatalf("Can not save the rest of %d metrics: %v\n", len(metrics)-sent, err)
+		}
+	}
+	if sent < len(metrics) {
+		os.Exit(1)
+	}
+}
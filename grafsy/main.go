@@ -4,7 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
 
 	"github.com/leoleovich/grafsy"
 )
@@ -52,11 +53,17 @@ func main() {
 		Mon:  mon,
 	}
 
-	var wg sync.WaitGroup
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
 	go mon.Run()
 	go srv.Run()
 	go cli.Run()
 
-	wg.Add(3)
-	wg.Wait()
+	<-signals
+	// Keep partial aggregation for the next start
+	if err := srv.SaveAggrState(); err != nil {
+		fmt.Println(err)
+		os.Exit(3)
+	}
 }
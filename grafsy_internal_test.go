@@ -2,11 +2,24 @@ package grafsy
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"math"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path"
 	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 var cleanMonitoring = &Monitoring{
@@ -181,9 +194,7 @@ func TestConfg_generateRegexpsForOverwrite(t *testing.T) {
 		t.Error(configError)
 	}
 
-	conf.Overwrite = []struct {
-		ReplaceWhatRegexp, ReplaceWith string
-	}{{"^test.*test ", "does not matter"}}
+	conf.Overwrite = []OverwriteRule{{ReplaceWhatRegexp: "^test.*test ", ReplaceWith: "does not matter"}}
 
 	regexps := conf.generateRegexpsForOverwrite()
 	if len(regexps) != 1 {
@@ -195,6 +206,53 @@ func TestConfg_generateRegexpsForOverwrite(t *testing.T) {
 	}
 }
 
+func TestServer_overwriteName(t *testing.T) {
+	testConf := *conf
+	testConf.Overwrite = []OverwriteRule{
+		{Name: "strip", ReplaceWhatRegexp: "^app[.]", ReplaceWith: "", Action: overwriteReplace, Continue: true},
+		{Name: "lower", ReplaceWhatRegexp: "^[^ ]+", Action: overwriteLower, Continue: true},
+		{Name: "sanitize", ReplaceWhatRegexp: "^[^ ]+", ReplaceWith: "_", Action: overwriteSanitize},
+		{Name: "never", ReplaceWhatRegexp: ".*", ReplaceWith: "never", Action: overwriteReplace},
+	}
+	testLc := *lc
+	testLc.overwriteRegexp = testConf.generateRegexpsForOverwrite()
+	m, _ := generateMonitoringObject()
+	s := Server{Conf: &testConf, Lc: &testLc, Mon: m}
+
+	metric := "app.Web/1.CPU 8 1500000000"
+	s.overwriteName(&metric)
+	if metric != "web_1.cpu 8 1500000000" {
+		t.Errorf("Wrong overwrite result: %s", metric)
+	}
+	if m.overwriteStat["strip"] != 1 || m.overwriteStat["lower"] != 1 || m.overwriteStat["sanitize"] != 1 || m.overwriteStat["never"] != 0 {
+		t.Errorf("Wrong counters of overwrite rules: %v", m.overwriteStat)
+	}
+}
+
+func TestOverwrite_sanitizeMetric(t *testing.T) {
+	tests := []struct {
+		metric    string
+		expected  string
+		sanitized bool
+	}{
+		{"a.b  8 1500000000", "a.b 8 1500000000", false},
+		{"a..b.ünï cödé 8 1500000000", "a.b._n__c 8 1500000000", true},
+		{".a.b/c;dc=ams 1 8 1500000000", "a.b_c;dc=ams_1 8 1500000000", true},
+		{"a.verylongnode.b 8 1500000000", "a.veryl.b 8 1500000000", true},
+	}
+	for _, test := range tests {
+		metric, sanitized := sanitizeMetric(test.metric, 5, regexp.MustCompile(`[^-a-zA-Z0-9_.]`))
+		if metric != test.expected || sanitized != test.sanitized {
+			t.Errorf("%q: expected %q (%v), got %q (%v)", test.metric, test.expected, test.sanitized, metric, sanitized)
+		}
+	}
+
+	// Characters allowed by default allowedNames are kept by default
+	if metric, sanitized := sanitizeMetric("a.b.f(x):1 8 1500000000", 0, lc.sanitizeRegexp); sanitized {
+		t.Errorf("Allowed characters must not be sanitized, got %q", metric)
+	}
+}
+
 func TestClient_retry(t *testing.T) {
 	var metricsFound int
 	err := cli.createRetryDir()
@@ -256,3 +314,1063 @@ func TestClient_tryToSendToGraphite(t *testing.T) {
 		}
 	}
 }
+
+func TestClient_httpBackend(t *testing.T) {
+	var received []string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("Content-Encoding") != "gzip" {
+			t.Error("Headers are not set")
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		// Only batches with bad metrics are rejected by the client error
+		if status >= 500 || status == http.StatusBadRequest && strings.Contains(strings.Join(lines, "\n"), "bad") {
+			w.WriteHeader(status)
+			return
+		}
+		received = append(received, lines...)
+	}))
+	defer srv.Close()
+
+	backend := &Backend{Addr: srv.URL + "/api/v1/import/graphite", Type: backendHTTP, Format: backendFormatGraphite,
+		Gzip: true, Headers: map[string]string{"Authorization": "Bearer token"}, BatchSize: 10}
+	m := &Monitoring{Conf: conf, Lc: lc, clientStat: map[string]*clientStat{backend.Addr: {}}}
+	testCli := Client{Conf: conf, Lc: lc, Mon: m}
+	conn := &httpConn{c: &testCli, carbonAddr: backend.Addr, backend: backend, client: srv.Client()}
+
+	for _, metric := range testMetrics {
+		if err := conn.write(metric); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(received) != 0 {
+		t.Error("Metrics must be buffered until flush")
+	}
+	if err := conn.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, testMetrics) || m.clientStat[backend.Addr].sent != len(testMetrics) {
+		t.Errorf("Unexpected metrics received: %v", received)
+	}
+
+	// Server errors must be retried
+	status = http.StatusServiceUnavailable
+	conn.write(testMetrics[0])
+	if unsent := unsentMetrics(conn.flush()); !reflect.DeepEqual(unsent, testMetrics[:1]) {
+		t.Errorf("Unexpected unsent metrics %v", unsent)
+	}
+
+	// Only rejected metrics must be dropped
+	status = http.StatusBadRequest
+	received = nil
+	batch := []string{testMetrics[0], "bad metric", testMetrics[1], testMetrics[0]}
+	for _, metric := range batch {
+		conn.write(metric)
+	}
+	if err := conn.flush(); err != nil || m.clientStat[backend.Addr].dropped != 1 {
+		t.Error("Rejected metrics must be dropped")
+	}
+	if expected := []string{testMetrics[0], testMetrics[1], testMetrics[0]}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("Accepted metrics must be sent, got %v", received)
+	}
+
+	if name := RetryFileName("http://localhost:8428/api/v1/import/graphite"); name != "http_localhost:8428_api_v1_import_graphite" {
+		t.Errorf("Unexpected retry file name %s", name)
+	}
+}
+
+func TestBackend_graphiteToInflux(t *testing.T) {
+	line, ok := graphiteToInflux("test.oleg;dc=ams 8 1500000000")
+	if !ok || line != "test.oleg,dc=ams value=8 1500000000000000000" {
+		t.Errorf("Unexpected line %s", line)
+	}
+}
+
+func TestDedup_deduplicator(t *testing.T) {
+	metrics := []string{
+		"a.b 1 1500000000",
+		"a.b 2 1500000000",
+		"a.b 3 1500000060",
+		"a.b;dc=ams 4 1500000000",
+		"a.b 5 1500000000",
+	}
+	for policy, expected := range map[string][]string{
+		dedupFirst: {"a.b 1 1500000000", "a.b 3 1500000060", "a.b;dc=ams 4 1500000000"},
+		dedupLast:  {"a.b 5 1500000000", "a.b 3 1500000060", "a.b;dc=ams 4 1500000000"},
+	} {
+		d := (&Config{Dedup: policy}).generateDeduplicator()
+		suppressed := 0
+		for _, metric := range metrics {
+			if !d.add(metric) {
+				suppressed++
+			}
+		}
+		if unique := d.flush(); !reflect.DeepEqual(unique, expected) || suppressed != 2 {
+			t.Errorf("%s: wrong unique metrics %v (suppressed %d)", policy, unique, suppressed)
+		}
+		// Duplicates of sent points are counted until the end of the send interval,
+		// with the last policy only a new value is sent to overwrite the sent one
+		if d.add(metrics[0]) || d.add("a.b;dc=ams 4 1500000000") {
+			t.Errorf("%s: sent metric must be a duplicate", policy)
+		}
+		if unique := d.flush(); (policy == dedupLast) != reflect.DeepEqual(unique, metrics[:1]) || (policy == dedupFirst && len(unique) != 0) {
+			t.Errorf("%s: wrong metrics after duplicates of sent metrics %v", policy, unique)
+		}
+		d.reset()
+		if !d.add(metrics[0]) {
+			t.Errorf("%s: metric must be unique after reset", policy)
+		}
+	}
+}
+
+func TestRetry_MoveRetryFile(t *testing.T) {
+	from, to := "localhost:2005", "localhost:2006"
+	err := WriteRetryFile(path.Join(conf.RetryDir, from), append(testMetrics, "broken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MoveRetryFile(conf.RetryDir, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := StatRetryFile(path.Join(conf.RetryDir, to))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Lines != len(testMetrics)+1 || info.Invalid != 1 {
+		t.Errorf("Wrong amount of lines in retry file: %d, invalid %d", info.Lines, info.Invalid)
+	}
+	if info.Oldest.Unix() != 1500000000 || info.Newest.Unix() != 1500000000 {
+		t.Errorf("Wrong time range of retry file: %v - %v", info.Oldest, info.Newest)
+	}
+
+	// Temporary files are not listed as backends
+	if err = os.WriteFile(path.Join(conf.RetryDir, retryTmpPrefix+to+".tmp"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ListRetryFiles(conf.RetryDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Backend, retryTmpPrefix) {
+			t.Errorf("Temporary file %s is listed as backend", file.Path)
+		}
+	}
+	os.Remove(path.Join(conf.RetryDir, retryTmpPrefix+to+".tmp"))
+
+	err = WriteRetryFile(path.Join(conf.RetryDir, to), nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetric_parseMetric(t *testing.T) {
+	tests := []struct {
+		line   string
+		metric string
+		reason string
+	}{
+		{"a.b;dc=ams  8.5\t1500000000", "a.b;dc=ams 8.5 1500000000", ""},
+		{"a.b -1e3 1500000000", "a.b -1000 1500000000", ""},
+		{"a..b 1 1500000000", "", rejectBadName},
+		{"a.b;dc 1 1500000000", "", rejectBadName},
+		{"a b 1 1500000000", "", rejectBadName},
+		{"a.b NaN 1500000000", "", rejectBadValue},
+		{"a.b +Inf 1500000000", "", rejectBadValue},
+		{"a.b", "", rejectBadValue},
+		{"a.b 1", "", rejectBadTimestamp},
+		{"a.b 1 1500000000000", "", rejectBadTimestamp},
+		{"a.b 1 " + strings.Repeat("1", 30), "", rejectTooLong},
+	}
+	for _, test := range tests {
+		m, reason := parseMetric(test.line, 32)
+		if reason != test.reason || reason == "" && m.String() != test.metric {
+			t.Errorf("%q: expected '%s' (%s), got '%s' (%s)", test.line, test.metric, test.reason, m.String(), reason)
+		}
+	}
+}
+
+func TestServer_validateMetric(t *testing.T) {
+	testLc := *lc
+	testLc.allowedNames = nil
+	testLc.allowedMetrics = regexp.MustCompile(`^[a-z.]+ 1e300 [0-9]{10}$`)
+	s := Server{Conf: conf, Lc: &testLc}
+	if _, reason := s.validateMetric("a.b 1e300 1500000000"); reason != "" {
+		t.Errorf("allowedMetrics must be matched against the received metric, got %s", reason)
+	}
+	if _, reason := s.validateMetric("a.b 1 1500000000"); reason != rejectNotAllowed {
+		t.Errorf("Wrong reason of rejection %s", reason)
+	}
+}
+
+func TestServer_filterMetric(t *testing.T) {
+	testConf := *conf
+	testConf.Filter = []FilterRule{
+		{Name: "keep_web1", Action: filterAllow, Prefixes: []string{"servers.web1"}},
+		{Name: "flood", Action: filterDeny, Prefixes: []string{"servers", "apps.noisy.debug"}},
+		{Name: "debug", Action: filterDeny, Regexp: `\.debug$`},
+	}
+	testLc := *lc
+	testLc.filters = testConf.generateFilters()
+	m, _ := generateMonitoringObject()
+	m.Conf = &testConf
+	s := Server{Conf: &testConf, Lc: &testLc, Mon: m}
+
+	tests := map[string]bool{
+		"servers.web1.cpu":       true,
+		"servers.web10.cpu":      false,
+		"apps.noisy.debug.count": false,
+		"apps.noisy.debugging":   true,
+		"apps.quiet.debug":       false,
+		"apps.quiet.info":        true,
+	}
+	for path, allowed := range tests {
+		if s.filterMetric(Metric{Path: path}) != allowed {
+			t.Errorf("%s must be allowed: %v", path, allowed)
+		}
+	}
+	if m.filterStat["keep_web1"] != 1 || m.filterStat["flood"] != 2 || m.filterStat["debug"] != 1 {
+		t.Errorf("Wrong hits of filter rules: %v", m.filterStat)
+	}
+}
+
+func TestLimit_prefixLimiter(t *testing.T) {
+	testConf := *conf
+	testConf.LimitPrefixDepth = 2
+	testConf.LimitPointsPerSecond = 3
+	testConf.LimitSeriesPerHour = 2
+	l := testConf.generateLimiter()
+	if p := pathPrefix("servers.web1.cpu", l.depth); p != "servers.web1" {
+		t.Errorf("Wrong prefix %s", p)
+	}
+	if p := pathPrefix("servers", l.depth); p != "servers" {
+		t.Errorf("Wrong prefix %s", p)
+	}
+
+	now := int64(1500000000)
+	check := func(path string, now int64, expected string) {
+		if _, reason := l.allow(Metric{Path: path}, now); reason != expected {
+			t.Errorf("%s at %d: expected '%s', got '%s'", path, now, expected, reason)
+		}
+	}
+	check("servers.web1.cpu", now, "")
+	check("servers.web1.mem", now, "")
+	check("servers.web1.disk", now, limitSeries)
+	check("servers.web1.cpu", now, "")
+	check("servers.web1.cpu", now, limitRate)
+	check("servers.web2.cpu", now, "")
+	check("servers.web1.cpu", now+1, "")
+	check("servers.web1.disk", now+3600, "")
+
+	// Series of points dropped by the rate limit are not counted
+	check("apps.x.a", now+7200, "")
+	check("apps.x.a", now+7200, "")
+	check("apps.x.a", now+7200, "")
+	check("apps.x.b", now+7200, limitRate)
+	check("apps.x.c", now+7201, "")
+}
+
+func TestCardinality_top(t *testing.T) {
+	testConf := *conf
+	testConf.CardinalityPrefixDepth = 2
+	c := testConf.generateCardinalityTracker()
+	for i := 0; i < 5000; i++ {
+		c.add(Metric{Path: "apps.noisy.request_" + strconv.Itoa(i)})
+	}
+	for i := 0; i < 6000; i++ {
+		c.add(Metric{Path: "servers.web1.cpu", Tags: []string{"core=" + strconv.Itoa(i%4)}})
+	}
+
+	byPoints := c.top(1, false)
+	if len(byPoints) != 1 || byPoints[0].Prefix != "servers.web1" || byPoints[0].Points != 6000 || byPoints[0].Series != 4 {
+		t.Errorf("Wrong top by points: %+v", byPoints)
+	}
+	bySeries := c.top(0, true)
+	if len(bySeries) != 2 || bySeries[0].Prefix != "apps.noisy" || math.Abs(float64(bySeries[0].Series-5000)) > 500 {
+		t.Errorf("Wrong top by series: %+v", bySeries)
+	}
+
+	c.reset()
+	if len(c.top(0, false)) != 0 {
+		t.Error("Tracker must be empty after reset")
+	}
+}
+
+func TestDownsample_downsampler(t *testing.T) {
+	testConf := *conf
+	testConf.Downsample = []DownsampleRule{
+		{Regexp: `\.max$`, Window: 60, Function: downsampleMax},
+		{Regexp: `^apps\.`, Window: 60, Function: downsampleAvg},
+		{Regexp: `^servers\.`, Window: 60, Function: downsampleLast},
+	}
+	d := testConf.generateDownsampler()
+	for i := int64(0); i < 70; i++ {
+		d.add(Metric{Path: "apps.rps", Value: float64(i), Timestamp: 1500000000 + i})
+		d.add(Metric{Path: "apps.rps.max", Value: float64(i), Timestamp: 1500000000 + i})
+		d.add(Metric{Path: "servers.web1.cpu", Value: float64(i), Timestamp: 1500000000 + i})
+	}
+	if d.add(Metric{Path: "other.metric", Value: 1, Timestamp: 1500000000}) != downsamplePassed {
+		t.Error("Metric without matching rule must not be downsampled")
+	}
+
+	// Windows start at 1500000000 and 1500000060
+	if metrics := d.flush(1500000059); len(metrics) != 0 {
+		t.Errorf("Window is not ended yet, but got %v", metrics)
+	}
+	metrics := d.flush(1500000060)
+	sort.Strings(metrics)
+	expected := []string{
+		"apps.rps 29.5 1500000000",
+		"apps.rps.max 59 1500000000",
+		"servers.web1.cpu 59 1500000000",
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("Wrong downsampled metrics %v", metrics)
+	}
+	if d.add(Metric{Path: "apps.rps", Value: 100, Timestamp: 1500000030}) != downsampleTooLate {
+		t.Error("Point of flushed window must be late")
+	}
+	if metrics = d.flush(1500000120); len(metrics) != 3 {
+		t.Errorf("Wrong downsampled metrics %v", metrics)
+	}
+	if d.add(Metric{Path: "apps.rps", Value: 100, Timestamp: 1500000030}) != downsampleConsumed {
+		t.Error("Flushed window must be forgotten after its length")
+	}
+}
+
+func TestServer_fixTimestamp(t *testing.T) {
+	testConf := *conf
+	testConf.TimestampFill = true
+	testConf.TimestampConvert = true
+	testConf.TimestampMaxPast = 3600
+	testConf.TimestampMaxFuture = 60
+	testConf.TimestampOutOfWindow = timestampClamp
+	s := Server{Conf: &testConf, Lc: lc, Mon: mon}
+	now := int64(1500000000)
+
+	tests := []struct {
+		metric   string
+		expected string
+		result   timestampResult
+	}{
+		{"a.b 1 1500000000", "a.b 1 1500000000", timestampKept},
+		{"a.b 1", "a.b 1 1500000000", timestampFilled},
+		{"a.b 1 N", "a.b 1 1500000000", timestampFilled},
+		{"a.b 1 -1", "a.b 1 1500000000", timestampFilled},
+		{"a.b 1 1499999999123", "a.b 1 1499999999", timestampConverted},
+		{"a.b 1 1499999999123456789", "a.b 1 1499999999", timestampConverted},
+		{"a.b 1 1600000000", "a.b 1 1500000060", timestampClamped},
+		{"a.b 1 1000000000000", "a.b 1 1499996400", timestampConverted | timestampClamped},
+		{"a.b 1 x", "a.b 1 x", timestampKept},
+	}
+	for _, test := range tests {
+		metric, result := s.fixTimestamp(test.metric, now)
+		if metric != test.expected || result != test.result {
+			t.Errorf("%s: expected '%s' (%d), got '%s' (%d)", test.metric, test.expected, test.result, metric, result)
+		}
+	}
+
+	testConf.TimestampOutOfWindow = timestampReject
+	if _, result := s.fixTimestamp("a.b 1 1400000000", now); result != timestampRejected {
+		t.Error("Old metric must be rejected")
+	}
+
+	// Rejected metrics are invalid
+	m, _ := generateMonitoringObject()
+	m.clean()
+	s.Mon = m
+	if stat := s.cleanAndUseIncomingData([]string{"a.b 1 1400000000"}); stat.invalid != 1 || m.serverStat.invalid != 1 {
+		t.Errorf("Old metric must be counted as invalid, got %d", m.serverStat.invalid)
+	}
+}
+
+func TestServer_ignoredMetricFile(t *testing.T) {
+	s := Server{Conf: &Config{MetricDirIgnore: []string{".*", "*.tmp"}}}
+	for name, ignored := range map[string]bool{
+		".hidden":     true,
+		"metrics.tmp": true,
+		"metrics.txt": false,
+		"metrics":     false,
+		"tmp.metrics": false,
+	} {
+		if s.ignoredMetricFile(name) != ignored {
+			t.Errorf("File %s must be ignored: %v", name, ignored)
+		}
+	}
+}
+
+func TestServer_handleMetricFile(t *testing.T) {
+	testConf := *conf
+	testConf.MetricDir = t.TempDir()
+	testConf.QuarantineDir = t.TempDir()
+	testConf.MetricDirMaxFileSize = 100
+	testLc := *lc
+	testLc.allowedNames = regexp.MustCompile(`^[-a-zA-Z0-9_.]+$`)
+	m, _ := generateMonitoringObject()
+	m.clean()
+	s := Server{Conf: &testConf, Lc: &testLc, Mon: m}
+
+	files := map[string]string{
+		"valid":   strings.Join(testMetrics[:1], "\n"),
+		"invalid": testMetrics[0] + "\nbad metric",
+		"big":     strings.Repeat(testMetrics[0]+"\n", 10),
+	}
+	for name, content := range files {
+		err := os.WriteFile(path.Join(testConf.MetricDir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.readDirMetrics("")
+
+	entries, _ := os.ReadDir(testConf.MetricDir)
+	if len(entries) != 0 {
+		t.Errorf("All files must be consumed, %d left", len(entries))
+	}
+	entries, _ = os.ReadDir(testConf.QuarantineDir)
+	if len(entries) != 2 || m.serverStat.quarantined != 2 {
+		t.Errorf("Files with invalid metrics and big files must be in quarantine, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), "_invalid.rejected") {
+			content, _ := os.ReadFile(path.Join(testConf.QuarantineDir, entry.Name()))
+			if string(content) != "bad metric\n" {
+				t.Errorf("Only rejected metrics must be in quarantine, got %q", content)
+			}
+		}
+	}
+	if m.serverStat.unreadable != 1 {
+		t.Errorf("Big file must be counted as unreadable, got %d", m.serverStat.unreadable)
+	}
+	s.reportUnreadable(path.Join(testConf.MetricDir, "fifo"), "Skipping fifo")
+	s.reportUnreadable(path.Join(testConf.MetricDir, "fifo"), "Skipping fifo")
+	if m.serverStat.unreadable != 2 {
+		t.Errorf("Unreadable file must be counted once, got %d", m.serverStat.unreadable-1)
+	}
+	for i := len(lc.mainChannel); i > 0; i-- {
+		<-lc.mainChannel
+	}
+}
+
+func TestServer_watchDirMetrics(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify is supported only on Linux")
+	}
+	testConf := *conf
+	testConf.MetricDir = t.TempDir()
+	testConf.MetricDirIgnore = []string{".*", "*.tmp"}
+	testLc := *lc
+	testLc.allowedNames = regexp.MustCompile(`^[-a-zA-Z0-9_.]+$`)
+	testLc.mainChannel = make(chan string, 10)
+	m, _ := generateMonitoringObject()
+	m.clean()
+	s := Server{Conf: &testConf, Lc: &testLc, Mon: m}
+
+	// The watch is removed together with metricDir in the end of the test
+	go s.watchDirMetrics()
+	time.Sleep(100 * time.Millisecond)
+
+	content := []byte(testMetrics[0] + "\n")
+	if err := os.WriteFile(path.Join(testConf.MetricDir, ".renamed.tmp"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path.Join(testConf.MetricDir, ".renamed.tmp"), path.Join(testConf.MetricDir, "renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(testConf.MetricDir, "written"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(testConf.MetricDir, "pending.tmp"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(testConf.MetricDir)
+	for i := 0; i < 50 && (len(entries) > 1 || len(testLc.mainChannel) < 2); i++ {
+		time.Sleep(100 * time.Millisecond)
+		entries, _ = os.ReadDir(testConf.MetricDir)
+	}
+	if len(entries) != 1 || entries[0].Name() != "pending.tmp" || len(testLc.mainChannel) != 2 {
+		t.Errorf("Renamed and written files must be consumed and ignored file must be kept, got %d metrics and %v", len(testLc.mainChannel), entries)
+	}
+}
+
+func TestServer_metricDirSource(t *testing.T) {
+	testConf := &Config{
+		MetricDirSource: []MetricDirSource{{
+			PathRegexp: `^(?P<team>[^/]+)/.*\.txt$`,
+			Prefix:     "team.${team}.",
+			Tags:       map[string]string{"source": "dir", "team": "$1"},
+		}},
+	}
+	testLc := &LocalConfig{metricDirSourceRegexp: testConf.generateRegexpsForMetricDirSource()}
+	s := Server{Conf: testConf, Lc: testLc}
+
+	if s.metricDirSource("metrics.txt") != nil {
+		t.Error("File in the root of metricDir must not match")
+	}
+	src := s.metricDirSource("backend/metrics.txt")
+	if src == nil {
+		t.Fatal("Source is not found")
+	}
+	if src.name != "team_backend" {
+		t.Errorf("Wrong name of the source: %s", src.name)
+	}
+	metric := src.apply(testMetrics[0])
+	if metric != "team.backend.test.oleg.test;source=dir;team=backend 8 1500000000" {
+		t.Errorf("Wrong metric: %s", metric)
+	}
+	if src = s.metricDirSource("front end/metrics.txt"); src.name != "team_front_end" {
+		t.Errorf("Wrong name of the source: %s", src.name)
+	}
+	if n := testConf.dirSourceNames(); n != maxDirSources {
+		t.Errorf("Names of sources with submatches are not known in advance, got %d", n)
+	}
+	if n := (&Config{MetricDirSource: []MetricDirSource{{Name: "a"}, {Prefix: "b."}}}).dirSourceNames(); n != 2 {
+		t.Errorf("Wrong amount of names of sources %d", n)
+	}
+}
+
+func TestFormats_readMetricsInFormat(t *testing.T) {
+	files := map[string]struct {
+		content string
+		metrics []string
+	}{
+		"metrics.json": {
+			`[{"name": "test.json.a", "value": 1.5, "ts": 1500000000}, {"name": "test.json.b", "value": 2, "tags": {"dc": "ams"}}, {"value": 3}]`,
+			[]string{"test.json.a 1.5 1500000000", "test.json.b;dc=ams 2 NOW"},
+		},
+		"metrics": {
+			` {"name": "test.json.c", "value": "-3e2", "ts": 1500000000}`,
+			[]string{"test.json.c -3e2 1500000000"},
+		},
+		"metrics.influx": {
+			"# comment\ncpu,host=web\\ 1,dc=ams usage=0.5,idle=99i,state=\"ok, fine\" 1500000000123456789\nbroken\n",
+			[]string{"cpu.usage;dc=ams;host=web_1 0.5 1500000000", "cpu.idle;dc=ams;host=web_1 99 1500000000"},
+		},
+		"metrics.txt": {
+			testMetrics[0] + "\n" + testMetrics[1],
+			testMetrics,
+		},
+	}
+	for name, file := range files {
+		before := time.Now().Unix()
+		metrics, _, err := readMetricsInFormat(name, strings.NewReader(file.content), lc.influxConverter)
+		after := time.Now().Unix()
+		if err != nil {
+			t.Errorf("Can not read %s: %v", name, err)
+		}
+		// Metrics without timestamp get the time of receiving
+		for i := range metrics {
+			for _, now := range []int64{before, after} {
+				metrics[i] = strings.Replace(metrics[i], " "+strconv.FormatInt(now, 10), " NOW", 1)
+			}
+		}
+		if !reflect.DeepEqual(metrics, file.metrics) {
+			t.Errorf("Wrong metrics from %s:\n Sample: %q\n Gotten: %q", name, file.metrics, metrics)
+		}
+	}
+}
+
+func TestInflux_convertLines(t *testing.T) {
+	line := "cpu,host=web1,dc=ams,core=0 usage=0.5 1500000000000000000"
+	templates := map[string]struct {
+		dropTags bool
+		metric   string
+	}{
+		"measurement.field":           {false, "cpu.usage;core=0;dc=ams;host=web1 0.5 1500000000"},
+		"host.measurement.field":      {true, "web1.cpu.usage 0.5 1500000000"},
+		"dc.host.measurement.missing": {false, "ams.web1.cpu;core=0 0.5 1500000000"},
+		"measurement.tags.field":      {false, "cpu.0.ams.web1.usage 0.5 1500000000"},
+	}
+	for template, sample := range templates {
+		c := &influxConverter{template: parsePathTemplate(template), dropTags: sample.dropTags}
+		metrics, invalid := c.convertLines([]string{line})
+		if invalid != 0 || len(metrics) != 1 || metrics[0] != sample.metric {
+			t.Errorf("Wrong conversion with template %s:\n Sample: %s\n Gotten: %q", template, sample.metric, metrics)
+		}
+	}
+}
+
+func TestServer_handleHTTPMetrics(t *testing.T) {
+	testLc := *lc
+	testLc.allowedNames = regexp.MustCompile(`^[-a-zA-Z0-9_.]+$`)
+	testLc.mainChannel = make(chan string, 2)
+	m, _ := generateMonitoringObject()
+	m.clean()
+	s := Server{Conf: conf, Lc: &testLc, Mon: m}
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte(testMetrics[0] + "\nbad metric\n"))
+	gz.Close()
+	req := httptest.NewRequest(http.MethodPost, "/metrics", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	s.handleHTTPMetrics(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"accepted":1,"rejected":1`) {
+		t.Errorf("Wrong response: %d %s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/metrics", strings.NewReader(`[{"name": "test.json", "value": 1, "ts": 1500000000}, {"name": "test.json", "value": 2, "ts": 1500000000}]`))
+	rec = httptest.NewRecorder()
+	s.handleHTTPMetrics(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"accepted":1,"rejected":0,"dropped":1`) {
+		t.Errorf("Partially accepted request must not be retried: %d %s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/metrics", strings.NewReader(testMetrics[0]))
+	rec = httptest.NewRecorder()
+	s.handleHTTPMetrics(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Wrong response to full queue: %d %s", rec.Code, rec.Body.String())
+	}
+	<-testLc.mainChannel
+	<-testLc.mainChannel
+
+	body.Reset()
+	gz = gzip.NewWriter(&body)
+	gz.Write(bytes.Repeat([]byte(" "), httpMaxBodySize+1))
+	gz.Close()
+	req = httptest.NewRequest(http.MethodPost, "/metrics", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	s.handleHTTPMetrics(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Too big decompressed body must be rejected: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTimer_metrics(t *testing.T) {
+	timer := &timerData{path: "apps.latency", tags: []string{"dc=ams"}}
+	for i := 100; i > 0; i-- {
+		timer.values = append(timer.values, float64(i)/100)
+	}
+	var metrics []string
+	for _, m := range timer.metrics([]float64{50, 99.9}, []float64{0.1, 0.5}, 1500000000) {
+		metrics = append(metrics, m.String())
+	}
+	expected := []string{
+		"apps.latency.count;dc=ams 100 1500000000",
+		"apps.latency.sum;dc=ams 50.5 1500000000",
+		"apps.latency.min;dc=ams 0.01 1500000000",
+		"apps.latency.max;dc=ams 1 1500000000",
+		"apps.latency.mean;dc=ams 0.505 1500000000",
+		"apps.latency.p50;dc=ams 0.5 1500000000",
+		"apps.latency.p99_9;dc=ams 1 1500000000",
+		"apps.latency.bucket.le_0_1;dc=ams 10 1500000000",
+		"apps.latency.bucket.le_0_5;dc=ams 50 1500000000",
+		"apps.latency.bucket.le_inf;dc=ams 100 1500000000",
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("Wrong timer metrics %v", metrics)
+	}
+
+	if (&timerData{}).metrics([]float64{50}, nil, 1500000000) != nil {
+		t.Error("Timer without values must have no metrics")
+	}
+
+	// Percentiles of merged timers are estimated from sketch
+	merged := &timerData{path: "apps.latency", sketch: timer.summary()}
+	metrics = nil
+	for _, m := range merged.metrics([]float64{50}, nil, 1500000000) {
+		metrics = append(metrics, m.String())
+	}
+	p50, _ := strconv.ParseFloat(strings.Fields(metrics[5])[1], 64)
+	if metrics[0] != "apps.latency.count 100 1500000000" || math.Abs(p50-0.5) > 0.5*timerSketchAccuracy {
+		t.Errorf("Wrong metrics of merged timer %v", metrics)
+	}
+}
+
+func TestAggregator_state(t *testing.T) {
+	testConf := *conf
+	testConf.TimerPrefix = "TIMER."
+	testConf.TimerPercentiles = []float64{50}
+	testConf.AggrCentral = true
+	stateFile := path.Join(t.TempDir(), "aggr.state")
+
+	before := testConf.generateAggregator()
+	before.deadline = 1500000060
+	before.add(Metric{Path: "SUM.apps.requests", Value: 10, Timestamp: 1500000001})
+	before.add(Metric{Path: "AVG.apps.load", Value: 1, Timestamp: 1500000001})
+	before.add(Metric{Path: "MIN.apps.free", Value: 5, Timestamp: 1500000001})
+	before.add(Metric{Path: "TIMER.apps.latency", Value: 1, Timestamp: 1500000001})
+	if err := before.save(stateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart in the same interval
+	after := testConf.generateAggregator()
+	after.deadline = 1500000060
+	after.add(Metric{Path: "SUM.apps.requests", Value: 5, Timestamp: 1500000030})
+	after.add(Metric{Path: "AVG.apps.load", Value: 3, Timestamp: 1500000030})
+	after.add(Metric{Path: "MIN.apps.free", Value: 7, Timestamp: 1500000030})
+	after.add(Metric{Path: "TIMER.apps.latency", Value: 3, Timestamp: 1500000030})
+	if err := after.load(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Error("State file must be removed after restore")
+	}
+
+	if metrics := after.flush(1500000059); len(metrics) != 0 {
+		t.Errorf("Interval is not ended yet, but got %v", metrics)
+	}
+	if metrics := after.flush(1500000060 + int64(testConf.AggrGrace) - 1); len(metrics) != 0 {
+		t.Errorf("Interval is sent before grace period, got %v", metrics)
+	}
+	metrics := after.flush(1500000060 + int64(testConf.AggrGrace))
+	sort.Strings(metrics)
+	expected := []string{
+		"apps.free 5.00 1500000060",
+		"apps.latency.count 2 1500000060",
+		"apps.latency.max 3 1500000060",
+		"apps.latency.mean 2 1500000060",
+		"apps.latency.min 1 1500000060",
+		"apps.latency.p50 1 1500000060",
+		"apps.latency.sum 4 1500000060",
+		"apps.load 2.00 1500000060",
+		"apps.requests 15.00 1500000060",
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("Wrong aggregated metrics %v", metrics)
+	}
+	if after.deadline != 1500000120 {
+		t.Errorf("Wrong deadline of the next interval %d", after.deadline)
+	}
+	if _, err := after.mergeState(&aggrState{Deadline: 1500000060}); err == nil {
+		t.Error("State of sent interval must be rejected")
+	}
+
+	// Existing series are aggregated when the interval is full
+	after.maxSize = 1
+	if !after.add(Metric{Path: "SUM.apps.requests", Value: 1}) || !after.add(Metric{Path: "SUM.apps.requests", Value: 1}) ||
+		after.add(Metric{Path: "SUM.apps.errors", Value: 1}) || after.add(Metric{Path: "TIMER.apps.latency", Value: 1}) {
+		t.Error("Wrong limit of aggregation interval")
+	}
+}
+
+func TestAggregator_forward(t *testing.T) {
+	m, _ := generateMonitoringObject()
+	m.clean()
+	centralLc := *lc
+	centralLc.allowedNames = nil
+	centralLc.aggregator = conf.generateAggregator()
+	central := &Server{Conf: conf, Lc: &centralLc, Mon: m}
+	central.Lc.aggregator.deadline = 1500000060
+	central.Lc.aggregator.add(Metric{Path: "AVG.dc.load", Value: 4, Timestamp: 1500000001})
+	central.Lc.aggregator.add(Metric{Path: "MAX.dc.load", Value: 4, Timestamp: 1500000001})
+	srv := httptest.NewServer(http.HandlerFunc(central.handleAggrState))
+	defer srv.Close()
+
+	leafConf := *conf
+	leafConf.AggrForward = srv.URL
+	leafLc := LocalConfig{lg: lc.lg, aggregator: leafConf.generateAggregator(), aggrForwarder: leafConf.generateAggrForwarder()}
+	leaf := Server{Conf: &leafConf, Lc: &leafLc, Mon: m}
+	// Intervals of instances are aligned
+	leafLc.aggregator.deadline = 1500000060
+	leafLc.aggregator.add(Metric{Path: "SUM.dc.requests", Value: 10, Timestamp: 1500000001})
+	leafLc.aggregator.add(Metric{Path: "AVG.dc.load", Value: 1, Timestamp: 1500000001})
+	leafLc.aggregator.add(Metric{Path: "AVG.dc.load", Value: 1, Timestamp: 1500000001})
+	leafLc.aggregator.add(Metric{Path: "MAX.dc.load", Value: 7, Timestamp: 1500000001})
+	if states := leafLc.aggregator.partial(1500000059); len(states) != 0 {
+		t.Errorf("Interval is not ended yet, but got %v", states)
+	}
+	if leafLc.aggregator.grace != 0 {
+		t.Error("Only central grafsy waits for forwarded states")
+	}
+	for _, state := range leafLc.aggregator.partial(1500000060) {
+		leaf.sendAggrState(state)
+	}
+	if !leafLc.aggregator.empty() || m.serverStat.aggrForwarded != 3 || m.serverStat.aggrMerged != 3 {
+		t.Errorf("Partial aggregation is not forwarded: %+v", m.serverStat)
+	}
+
+	metrics := central.Lc.aggregator.flush(1500000060 + int64(conf.AggrGrace))
+	sort.Strings(metrics)
+	expected := []string{
+		"dc.load 2.00 1500000060",
+		"dc.load 7.00 1500000060",
+		"dc.requests 10.00 1500000060",
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("Wrong cluster-wide metrics %v", metrics)
+	}
+
+	// Malformed states are rejected
+	for _, state := range []string{
+		`{"deadline": 1500000120, "timers": {"TIMER.dc.latency": {"path": "TIMER.dc.latency"}}}`,
+		`{"deadline": 1500000120, "metrics": {"servers.evil": {"value": 1}}}`,
+		`{"deadline": 1500000120, "metrics": {"AVG.dc.load": {"value": 1, "amount": 0}}}`,
+	} {
+		rec := httptest.NewRecorder()
+		central.handleAggrState(rec, httptest.NewRequest(http.MethodPost, "/aggregate", strings.NewReader(state)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Malformed state %s must be rejected, got %d", state, rec.Code)
+		}
+	}
+
+	// Retried state is merged once
+	state := &aggrState{Source: "leaf", Deadline: 1500000120, Metrics: map[string]aggrStateValue{"SUM.dc.requests": {Value: 1}}}
+	if merged, err := central.Lc.aggregator.mergeState(state); !merged || err != nil {
+		t.Errorf("State is not merged: %v", err)
+	}
+	if merged, err := central.Lc.aggregator.mergeState(state); merged || err != nil {
+		t.Errorf("State of the same source and interval must be merged once: %v", err)
+	}
+
+	// Failed forward is retried and dropped after the last attempt
+	srv.Close()
+	leafLc.aggregator.add(Metric{Path: "SUM.dc.requests", Value: 10, Timestamp: 1500000061})
+	for _, state := range leafLc.aggregator.partial(1500000120) {
+		leaf.sendAggrState(state)
+	}
+	if m.serverStat.aggrForwardErrors != maxAggrForwardAttempts || m.serverStat.aggrForwardDropped != 1 {
+		t.Error("Partial aggregation must be dropped after the last attempt")
+	}
+}
+
+func TestRate_derive(t *testing.T) {
+	testConf := *conf
+	testConf.RateMaxGap = 600
+	testConf.Rate = []RateRule{
+		{Regexp: `^net\.(.+)\.octets$`, Output: "net.$1.bps", MaxValue: 4294967295},
+		{Regexp: `^requests$`, Output: defaultRateOutput, Keep: true},
+	}
+	d := testConf.generateRateDeriver()
+
+	if _, matched, keep := d.derive(Metric{Path: "other", Value: 1, Timestamp: 1500000000}); matched || !keep {
+		t.Error("Metric without matching rule must be sent as is")
+	}
+	if rate, matched, keep := d.derive(Metric{Path: "net.eth0.octets", Value: 4294967000, Timestamp: 1500000000}); rate != nil || !matched || keep {
+		t.Errorf("The first point must not produce a rate, got %v", rate)
+	}
+	rate, _, _ := d.derive(Metric{Path: "net.eth0.octets", Value: 4294967200, Timestamp: 1500000010})
+	if rate == nil || rate.String() != "net.eth0.bps 20 1500000010" {
+		t.Errorf("Wrong rate %v", rate)
+	}
+	// Wraparound of 32-bit counter
+	rate, _, _ = d.derive(Metric{Path: "net.eth0.octets", Value: 104, Timestamp: 1500000020})
+	if rate == nil || rate.Value != 20 {
+		t.Errorf("Wrong rate after wraparound %v", rate)
+	}
+	if rate, matched, _ := d.derive(Metric{Path: "net.eth0.octets", Value: 1, Timestamp: 1500000015}); rate != nil || !matched {
+		t.Errorf("Point out of order must be ignored, got %v", rate)
+	}
+
+	d.derive(Metric{Path: "requests", Tags: []string{"dc=ams"}, Value: 1000, Timestamp: 1500000000})
+	// Reset of counter without maxValue
+	rate, _, keep := d.derive(Metric{Path: "requests", Tags: []string{"dc=ams"}, Value: 50, Timestamp: 1500000010})
+	if rate == nil || rate.String() != "requests.rate;dc=ams 5 1500000010" || !keep {
+		t.Errorf("Wrong rate after reset %v", rate)
+	}
+	// Gap between points is too big
+	if rate, _, _ := d.derive(Metric{Path: "requests", Tags: []string{"dc=ams"}, Value: 100, Timestamp: 1500001000}); rate != nil {
+		t.Errorf("Rate must not be derived after a big gap, got %v", rate)
+	}
+}
+
+func TestPrometheus_decodePromWriteRequest(t *testing.T) {
+	appendMessage := func(b []byte, num protowire.Number, msg []byte) []byte {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, msg)
+	}
+	label := func(name, value string) []byte {
+		return appendMessage(appendMessage(nil, 1, []byte(name)), 2, []byte(value))
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(0.25))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, 1500000000123)
+
+	var series []byte
+	series = appendMessage(series, 1, label("__name__", "http_requests"))
+	series = appendMessage(series, 1, label("job", "api"))
+	series = appendMessage(series, 1, label("code", "200"))
+	series = appendMessage(series, 2, sample)
+	request := appendMessage(nil, 1, series)
+
+	allSeries, err := decodePromWriteRequest(request)
+	if err != nil || len(allSeries) != 1 {
+		t.Fatalf("Can not decode WriteRequest: %v", err)
+	}
+	c := &promConverter{template: parsePathTemplate("job.name")}
+	metrics := c.graphiteMetrics(allSeries[0])
+	if len(metrics) != 1 || metrics[0] != "api.http_requests;code=200 0.25 1500000000" {
+		t.Errorf("Wrong conversion of series: %q", metrics)
+	}
+}
+
+func TestPrometheus_handlePromWrite(t *testing.T) {
+	s := Server{Conf: conf, Lc: lc, Mon: cleanMonitoring}
+	// Snappy block, which declares 2GB of decompressed data
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(protowire.AppendVarint(nil, 1<<31)))
+	rec := httptest.NewRecorder()
+	s.handlePromWrite(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Too big decompressed body must be rejected: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPrometheus_graphiteToPromSeries(t *testing.T) {
+	metrics := []string{
+		"servers.web1.cpu.user;dc=ams 8 1500000010",
+		"servers.web1.cpu.user;dc=ams 7 1500000000",
+		"short 1 1500000000",
+		"broken",
+	}
+	allSeries, invalid := graphiteToPromSeries(metrics, parsePathTemplate("_.host.name"))
+	if invalid != 1 {
+		t.Errorf("Expected 1 invalid metric, got %d", invalid)
+	}
+
+	decoded, err := decodePromWriteRequest(encodePromWriteRequest(allSeries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*promSeries{
+		{
+			labels:  map[string]string{promNameLabel: "cpu_user", "host": "web1", "dc": "ams"},
+			samples: []promSample{{7, 1500000000000}, {8, 1500000010000}},
+		},
+		{
+			labels:  map[string]string{promNameLabel: "short"},
+			samples: []promSample{{1, 1500000000000}},
+		},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("Unexpected series %v", decoded)
+	}
+}
+
+func TestScrape_convertText(t *testing.T) {
+	text := `# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 0.5
+http_requests_total{code="200",path="/a \"b\""} 10 1500000000000
+broken{code="200" 1
+`
+	c := &promConverter{template: parsePathTemplate("name.code")}
+	metrics, invalid, err := c.convertText(strings.NewReader(text), "servers.test.", 1600000000000)
+	if err != nil || invalid != 1 {
+		t.Errorf("Wrong amount of invalid lines %d: %v", invalid, err)
+	}
+	sample := []string{
+		"servers.test.node_load1 0.5 1600000000",
+		`servers.test.http_requests_total.200;path=/a_"b" 10 1500000000`,
+	}
+	if !reflect.DeepEqual(metrics, sample) {
+		t.Errorf("Wrong conversion:\n Sample: %q\n Gotten: %q", sample, metrics)
+	}
+}
+
+func TestOTLP_handleOTLPMetrics(t *testing.T) {
+	testLc := *lc
+	testLc.allowedNames = regexp.MustCompile(`^[-a-zA-Z0-9_.]+$`)
+	testLc.mainChannel = make(chan string, 1)
+	m, _ := generateMonitoringObject()
+	m.clean()
+	s := Server{Conf: conf, Lc: &testLc, Mon: m}
+
+	request := `{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "test.otlp", "gauge": {"dataPoints": [
+		{"timeUnixNano": "1500000000000000000", "asDouble": 1},
+		{"timeUnixNano": "1500000001000000000", "asDouble": 2}
+	]}}]}]}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(request))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.handleOTLPMetrics(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"rejectedDataPoints":"1"`) {
+		t.Errorf("Partially accepted request must not be retried: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestOTLP_graphiteMetrics(t *testing.T) {
+	request := `{"resourceMetrics": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "api"}}]},
+		"scopeMetrics": [{"metrics": [
+			{"name": "http.requests", "sum": {"dataPoints": [
+				{"attributes": [{"key": "code", "value": {"intValue": "200"}}], "timeUnixNano": "1500000000000000000", "asInt": "10"}
+			]}},
+			{"name": "http.duration", "histogram": {"dataPoints": [
+				{"timeUnixNano": "1500000000000000000", "count": "4", "sum": 10, "bucketCounts": ["2", "2", "0"], "explicitBounds": [1, 5]}
+			]}}
+		]}]
+	}]}`
+	resources, err := decodeOTLPJSONRequest([]byte(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &otlpConverter{template: parsePathTemplate("service_name.name"), percentiles: []float64{50, 75}}
+	sample := []string{
+		"api.http.requests;code=200 10 1500000000",
+		"api.http.duration.count 4 1500000000",
+		"api.http.duration.sum 10 1500000000",
+		"api.http.duration.bucket.le_1 2 1500000000",
+		"api.http.duration.bucket.le_5 4 1500000000",
+		"api.http.duration.bucket.le_inf 4 1500000000",
+		"api.http.duration.p50 1 1500000000",
+		"api.http.duration.p75 3 1500000000",
+	}
+	metrics := c.graphiteMetrics(resources)
+	if !reflect.DeepEqual(metrics, sample) {
+		t.Errorf("Wrong conversion:\n Sample: %q\n Gotten: %q", sample, metrics)
+	}
+
+	// The same gauge in protobuf encoding
+	appendMessage := func(b []byte, num protowire.Number, msg []byte) []byte {
+		return protowire.AppendBytes(protowire.AppendTag(b, num, protowire.BytesType), msg)
+	}
+	var point []byte
+	point = protowire.AppendTag(point, 3, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, 1500000000000000000)
+	point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, math.Float64bits(0.5))
+	point = appendMessage(point, 7, appendMessage(appendMessage(nil, 1, []byte("code")), 2, appendMessage(nil, 1, []byte("200"))))
+	metric := appendMessage(appendMessage(nil, 1, []byte("http.load")), 5, appendMessage(nil, 1, point))
+	resource := appendMessage(nil, 1, appendMessage(nil, 1, appendMessage(appendMessage(nil, 1, []byte("service.name")), 2, appendMessage(nil, 1, []byte("api")))))
+	resource = appendMessage(resource, 2, appendMessage(nil, 2, metric))
+	resources, err = decodeOTLPRequest(appendMessage(nil, 1, resource))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics = c.graphiteMetrics(resources)
+	if len(metrics) != 1 || metrics[0] != "api.http.load;code=200 0.5 1500000000" {
+		t.Errorf("Wrong conversion of protobuf: %q", metrics)
+	}
+
+	// Histograms with wrong amount of bounds are skipped in both encodings
+	request = `{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "http.duration", "histogram": {"dataPoints": [
+		{"timeUnixNano": "1500000000000000000", "count": "3", "bucketCounts": ["0", "1", "2"]}
+	]}}]}]}]}`
+	resources, err = decodeOTLPJSONRequest([]byte(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metric := resources[0].metrics[0]; len(metric.points) != 0 || metric.invalid != 1 {
+		t.Errorf("Malformed JSON histogram must be invalid: %+v", metric)
+	}
+	var counts []byte
+	for _, count := range []uint64{0, 1, 2} {
+		counts = protowire.AppendFixed64(counts, count)
+	}
+	metric = appendMessage(appendMessage(nil, 1, []byte("http.duration")), 9, appendMessage(nil, 1, appendMessage(nil, 6, counts)))
+	resources, err = decodeOTLPRequest(appendMessage(nil, 1, appendMessage(nil, 2, appendMessage(nil, 2, metric))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metric := resources[0].metrics[0]; len(metric.points) != 0 || metric.invalid != 1 {
+		t.Errorf("Malformed protobuf histogram must be invalid: %+v", metric)
+	}
+}
@@ -0,0 +1,159 @@
+package grafsy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Maximum size of HTTP request body after decompression
+const httpMaxBodySize = 32 << 20
+
+// The response of HTTP ingestion endpoints
+type httpIngestResponse struct {
+	// Amount of metrics accepted for sending.
+	Accepted int `json:"accepted"`
+
+	// Amount of invalid metrics.
+	Rejected int `json:"rejected"`
+
+	// Amount of valid metrics dropped because of full queues.
+	Dropped int `json:"dropped"`
+
+	// Amount of valid metrics dropped because of limits of their prefixes.
+	Limited int `json:"limited"`
+
+	// Error description.
+	Error string `json:"error,omitempty"`
+}
+
+// Write response in JSON format
+func writeHTTPResponse(w http.ResponseWriter, status int, resp *httpIngestResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Body of request, decompressed according to Content-Encoding and limited by httpMaxBodySize
+func httpRequestBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	body := http.MaxBytesReader(w, r.Body, httpMaxBodySize)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		// Decompressed body over the limit is an error, not a truncated body
+		return struct {
+			io.Reader
+			io.Closer
+		}{http.MaxBytesReader(w, gz, httpMaxBodySize), body}, nil
+	}
+	return nil, errors.New("unsupported Content-Encoding " + r.Header.Get("Content-Encoding"))
+}
+
+// Check if main or aggregation channel is full and new metrics will be dropped
+func (s *Server) queueFull() bool {
+	return len(s.Lc.mainChannel) >= cap(s.Lc.mainChannel) || len(s.Lc.aggrChannel) >= cap(s.Lc.aggrChannel)
+}
+
+// Status of request with body, which can not be read
+func httpBodyErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Receive metrics in Graphite plaintext or JSON format.
+// The format is taken from Content-Type or detected by the first byte.
+func (s *Server) handleHTTPMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeHTTPResponse(w, http.StatusMethodNotAllowed, &httpIngestResponse{Error: "only POST is allowed"})
+		return
+	}
+	if s.queueFull() {
+		writeHTTPResponse(w, http.StatusTooManyRequests, &httpIngestResponse{Error: "queue is full"})
+		return
+	}
+
+	body, err := httpRequestBody(w, r)
+	if err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, &httpIngestResponse{Error: err.Error()})
+		return
+	}
+	defer body.Close()
+
+	br := bufio.NewReader(body)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var format int
+	switch mediaType {
+	case "application/json":
+		format = formatJSON
+	case "text/plain":
+		format = formatPlain
+	default:
+		format = detectFileFormat("", br)
+	}
+
+	metrics, unconverted, err := readMetricsOfFormat(format, br, s.Lc.influxConverter)
+	if err != nil {
+		writeHTTPResponse(w, httpBodyErrorStatus(err), &httpIngestResponse{Error: err.Error()})
+		return
+	}
+	if unconverted > 0 {
+		s.Mon.Increase(&s.Mon.serverStat.invalid, unconverted)
+	}
+
+	s.Mon.Increase(&s.Mon.serverStat.http, len(metrics)+unconverted)
+	stat := s.cleanAndUseIncomingData(metrics)
+	resp := &httpIngestResponse{
+		Accepted: stat.accepted,
+		Rejected: stat.invalid + unconverted,
+		Dropped:  stat.dropped,
+		Limited:  stat.limited,
+	}
+	if stat.dropped > 0 {
+		resp.Error = "queue is full, some metrics were dropped"
+		if stat.accepted == 0 {
+			// Nothing is enqueued, so the client may safely retry the whole request
+			writeHTTPResponse(w, http.StatusTooManyRequests, resp)
+			return
+		}
+	}
+	writeHTTPResponse(w, http.StatusOK, resp)
+}
+
+// Run HTTP listener
+func (s *Server) handleHTTP() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleHTTPMetrics)
+	mux.HandleFunc("/api/v1/write", s.handlePromWrite)
+	mux.HandleFunc("/v1/metrics", s.handleOTLPMetrics)
+	if s.Conf.AggrCentral {
+		mux.HandleFunc("/aggregate", s.handleAggrState)
+	}
+	mux.HandleFunc("/debug/cardinality", s.handleCardinality)
+
+	srv := &http.Server{
+		Addr:              s.Conf.HTTPBind,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(s.Conf.ClientSendInterval) * time.Second,
+		ErrorLog:          s.Lc.lg,
+	}
+	s.Lc.lg.Println("HTTP server is running on", s.Conf.HTTPBind)
+	err := srv.ListenAndServe()
+	s.Lc.lg.Println("Failed to run HTTP server:", err.Error())
+	os.Exit(1)
+}
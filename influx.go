@@ -0,0 +1,211 @@
+package grafsy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A single field of InfluxDB line protocol point
+type influxField struct {
+	key string
+
+	// Numeric value in Graphite format
+	value string
+}
+
+// A point of InfluxDB line protocol:
+// measurement[,tag=value...] field=value[,field=value...] [timestamp]
+type influxPoint struct {
+	measurement string
+
+	tags map[string]string
+
+	fields []influxField
+
+	// Timestamp in seconds, 0 if point does not have it
+	timestamp int64
+}
+
+// Split s by sep, which is not escaped by backslash or quoted
+func splitInfluxEscaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Remove escaping backslashes
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Convert field value of line protocol to Graphite value.
+// Strings are not supported by Graphite, so they return false.
+func influxFieldValue(value string) (string, bool) {
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return "1", true
+	case "f", "F", "false", "False", "FALSE":
+		return "0", true
+	}
+	if strings.HasSuffix(value, "i") || strings.HasSuffix(value, "u") {
+		value = value[:len(value)-1]
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+				return "", false
+			}
+		}
+		return value, true
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return "", false
+	}
+	return value, true
+}
+
+// Parse a line of InfluxDB line protocol
+func parseInfluxLine(line string) (*influxPoint, error) {
+	line = strings.TrimSpace(line)
+	sections := splitInfluxEscaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, errors.New("wrong amount of sections")
+	}
+
+	point := &influxPoint{tags: make(map[string]string)}
+	series := splitInfluxEscaped(sections[0], ',', false)
+	point.measurement = unescapeInflux(series[0])
+	if point.measurement == "" {
+		return nil, errors.New("empty measurement")
+	}
+	for _, tag := range series[1:] {
+		kv := splitInfluxEscaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.New("invalid tag " + tag)
+		}
+		point.tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	for _, field := range splitInfluxEscaped(sections[1], ',', true) {
+		kv := splitInfluxEscaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.New("invalid field " + field)
+		}
+		value, ok := influxFieldValue(kv[1])
+		if !ok {
+			// String fields can not be stored in Graphite
+			continue
+		}
+		point.fields = append(point.fields, influxField{key: unescapeInflux(kv[0]), value: value})
+	}
+	if len(point.fields) == 0 {
+		return nil, errors.New("no numeric fields")
+	}
+
+	if len(sections) == 3 {
+		ns, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid timestamp " + sections[2])
+		}
+		point.timestamp = ns / 1e9
+	}
+	return point, nil
+}
+
+// Replace characters, which are not allowed in Graphite path
+func graphiteSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '.', ';', '=':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Replace characters, which are not allowed in Graphite tag value
+func graphiteTagSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', ';':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Default template to convert InfluxDB line protocol to Graphite
+const defaultInfluxTemplate = "measurement.field"
+
+// Rules to convert InfluxDB line protocol to Graphite
+type influxConverter struct {
+	// Template of Graphite path.
+	template pathTemplate
+
+	// Drop tags, which are not used in the template, instead of converting them to Graphite tags.
+	dropTags bool
+}
+
+// Convert point to Graphite metrics in format <path>;tag=value <value> <timestamp>.
+// One metric is generated per field.
+func (c *influxConverter) graphiteMetrics(p *influxPoint) []string {
+	metrics := make([]string, 0, len(p.fields))
+	timestamp := p.timestamp
+	if timestamp == 0 {
+		// Point without timestamp is received now
+		timestamp = time.Now().Unix()
+	}
+	for _, field := range p.fields {
+		special := map[string]string{
+			"measurement": graphiteSafe(p.measurement),
+			"field":       graphiteSafe(field.key),
+		}
+		path, tags := c.template.build(special, p.tags, c.dropTags)
+		metric := path + tags + " " + field.value + " " + strconv.FormatInt(timestamp, 10)
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// Convert lines of InfluxDB line protocol to Graphite plaintext format.
+// Empty lines and comments are skipped.
+// Return converted metrics and amount of lines which can not be converted.
+func (c *influxConverter) convertLines(lines []string) ([]string, int) {
+	var metrics []string
+	invalid := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := parseInfluxLine(line)
+		if err != nil {
+			invalid++
+			continue
+		}
+		metrics = append(metrics, c.graphiteMetrics(point)...)
+	}
+	return metrics, invalid
+}
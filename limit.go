@@ -0,0 +1,138 @@
+package grafsy
+
+import (
+	"strings"
+	"sync"
+)
+
+// Maximum amount of limited prefixes reported per monitoring interval.
+// Statistic of the rest is reported under otherLimitPrefix.
+const maxLimitPrefixes = 100
+
+// Name of the prefix for statistic which does not fit into maxLimitPrefixes.
+const otherLimitPrefix = "other"
+
+// Reasons of metric dropping by limiter
+const (
+	limitRate   = "rate"
+	limitSeries = "series"
+)
+
+// The statistic of metrics dropped by limiter per prefix
+type limitStat struct {
+	// Amount of metrics over points per second limit.
+	rate int
+
+	// Amount of metrics of new series over series per hour limit.
+	series int
+}
+
+// Limits of points per second and distinct series per hour for every prefix of metric path
+type prefixLimiter struct {
+	mu sync.Mutex
+
+	// Amount of nodes of metric path in the prefix.
+	depth int
+
+	// Maximum points per second per prefix, 0 means no limit.
+	pointsPerSecond int
+
+	// Maximum distinct series per hour per prefix, 0 means no limit.
+	seriesPerHour int
+
+	// Current second and points of prefixes in it.
+	second int64
+	points map[string]int
+
+	// Current hour and series of prefixes in it.
+	hour   int64
+	series map[string]map[string]struct{}
+}
+
+// Create limiter from config. Return nil if limits are disabled.
+func (conf *Config) generateLimiter() *prefixLimiter {
+	if conf.LimitPrefixDepth <= 0 || conf.LimitPointsPerSecond <= 0 && conf.LimitSeriesPerHour <= 0 {
+		return nil
+	}
+	return &prefixLimiter{
+		depth:           conf.LimitPrefixDepth,
+		pointsPerSecond: conf.LimitPointsPerSecond,
+		seriesPerHour:   conf.LimitSeriesPerHour,
+		points:          make(map[string]int),
+		series:          make(map[string]map[string]struct{}),
+	}
+}
+
+// Get the prefix of metric path by the first depth nodes
+func pathPrefix(path string, depth int) string {
+	end := 0
+	for i := 0; i < depth; i++ {
+		next := strings.IndexByte(path[end:], '.')
+		if next < 0 {
+			return path
+		}
+		end += next + 1
+	}
+	if end == 0 {
+		return path
+	}
+	return path[:end-1]
+}
+
+// Check if metric fits into limits of its prefix at the time now (in seconds).
+// Return the prefix and the reason of dropping if it does not fit.
+func (l *prefixLimiter) allow(m Metric, now int64) (string, string) {
+	prefix := pathPrefix(m.Path, l.depth)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The rate is checked first, so a point dropped by the rate limit does not take a slot of series
+	if l.pointsPerSecond > 0 {
+		if now != l.second {
+			l.second = now
+			l.points = make(map[string]int)
+		}
+		if l.points[prefix] >= l.pointsPerSecond {
+			return prefix, limitRate
+		}
+	}
+
+	if l.seriesPerHour > 0 {
+		if hour := now / 3600; hour != l.hour {
+			l.hour = hour
+			l.series = make(map[string]map[string]struct{})
+		}
+		prefixSeries, ok := l.series[prefix]
+		if !ok {
+			prefixSeries = make(map[string]struct{})
+			l.series[prefix] = prefixSeries
+		}
+		name := m.Name()
+		if _, known := prefixSeries[name]; !known {
+			if len(prefixSeries) >= l.seriesPerHour {
+				return prefix, limitSeries
+			}
+			prefixSeries[name] = struct{}{}
+		}
+	}
+
+	if l.pointsPerSecond > 0 {
+		l.points[prefix]++
+	}
+	return prefix, ""
+}
+
+// Check limits of metric and count it if it is dropped.
+// Return false if metric is dropped.
+func (s Server) limitMetric(m Metric, now int64) bool {
+	if s.Lc.limiter == nil {
+		return true
+	}
+	prefix, reason := s.Lc.limiter.allow(m, now)
+	if reason == "" {
+		return true
+	}
+	s.Mon.increaseLimit(strings.Replace(prefix, ".", "_", -1), reason)
+	return false
+}
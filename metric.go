@@ -2,10 +2,102 @@ package grafsy
 
 import (
 	"bufio"
+	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 )
 
-// The main content of metric in format <name> <value> <timestamp>
+// Reasons of metric rejection by parser
+const (
+	rejectBadName      = "bad_name"
+	rejectBadValue     = "bad_value"
+	rejectBadTimestamp = "bad_timestamp"
+	rejectTooLong      = "too_long"
+
+	// Metric does not match allowedMetrics
+	rejectNotAllowed = "not_allowed"
+
+	// Timestamp is outside of the allowed window, it is counted by timestamp stats
+	rejectTimestampWindow = "timestamp_window"
+)
+
+// Metric is a parsed metric in Graphite format <path>[;tag=value...] <value> <timestamp>
+type Metric struct {
+	// Path is the name of the metric without tags.
+	Path string
+
+	// Tags are Graphite tags in format tag=value in the original order.
+	Tags []string
+
+	// Value of the metric.
+	Value float64
+
+	// Timestamp of the metric. In seconds.
+	Timestamp int64
+}
+
+// Name returns the path with tags, e.g. a.b;tag=value
+func (m Metric) Name() string {
+	if len(m.Tags) == 0 {
+		return m.Path
+	}
+	return m.Path + ";" + strings.Join(m.Tags, ";")
+}
+
+// String returns the metric in Graphite plaintext format
+func (m Metric) String() string {
+	value, _ := formatGraphiteValue(m.Value)
+	return m.Name() + " " + value + " " + strconv.FormatInt(m.Timestamp, 10)
+}
+
+// Parse metric in format <path>[;tag=value...] <value> <timestamp> separated by any whitespaces.
+// Lines longer than maxLength are rejected, 0 means no limit.
+// Return the reason of rejection if metric is invalid.
+func parseMetric(line string, maxLength int) (Metric, string) {
+	var m Metric
+	if maxLength > 0 && len(line) > maxLength {
+		return m, rejectTooLong
+	}
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) < 2:
+		return m, rejectBadValue
+	case len(fields) == 2:
+		return m, rejectBadTimestamp
+	case len(fields) > 3:
+		// Most probably there are whitespaces in the name
+		return m, rejectBadName
+	}
+
+	nameAndTags := strings.Split(fields[0], ";")
+	m.Path = nameAndTags[0]
+	if m.Path == "" || strings.HasPrefix(m.Path, ".") || strings.HasSuffix(m.Path, ".") || strings.Contains(m.Path, "..") {
+		return m, rejectBadName
+	}
+	for _, tag := range nameAndTags[1:] {
+		if eq := strings.IndexByte(tag, '='); eq <= 0 || eq == len(tag)-1 {
+			return m, rejectBadName
+		}
+	}
+	m.Tags = nameAndTags[1:]
+
+	var err error
+	m.Value, err = strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return m, rejectBadValue
+	}
+
+	m.Timestamp, err = strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || m.Timestamp < 0 || m.Timestamp >= 1e10 {
+		return m, rejectBadTimestamp
+	}
+	return m, ""
+}
+
+// The aggregated content of metric in format <name> <value> <timestamp>
 // Name is not in the structure because it is a key of related map
 type metricData struct {
 	value  float64
@@ -24,13 +116,49 @@ func readMetricsFromFile(file string) ([]string, error) {
 	// Think about Truncate
 	defer os.Remove(file)
 
-	scanner := bufio.NewScanner(f)
+	resultsList, _ = readLines(f)
+
+	// It should first call Close and only then defer with removing of file
+	return resultsList, f.Close()
+}
+
+// Reading all lines from reader
+// Return lines read before an error as well
+func readLines(r io.Reader) ([]string, error) {
+	var resultsList []string
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		resultsList = append(resultsList, scanner.Text())
 	}
+	return resultsList, scanner.Err()
+}
+
+// Move file to another place, even to another filesystem
+func moveFile(src, dst string) error {
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
 
-	// It should first call Close and only then defer with removing of file
-	return resultsList, f.Close()
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
 }
 
 // Get amount of lines of file
@@ -2,6 +2,7 @@ package grafsy
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,6 +23,18 @@ type Monitoring struct {
 
 	// Statistic per carbon receiver
 	clientStat map[string]*clientStat
+
+	// Statistic per source of metricDir
+	dirSourceStat map[string]*dirSourceStat
+
+	// Hits per filter rule
+	filterStat map[string]int
+
+	// Rewritten metrics per overwrite rule
+	overwriteStat map[string]int
+
+	// Metrics dropped by limiter per prefix
+	limitStat map[string]*limitStat
 }
 
 // The source of metric daemon got.
@@ -34,6 +47,87 @@ type serverStat struct {
 
 	// Amount of metrics from network.
 	net int
+
+	// Amount of metrics from InfluxDB line protocol listener.
+	influx int
+
+	// Amount of metrics from HTTP listener.
+	http int
+
+	// Amount of metrics from Prometheus remote_write.
+	prometheus int
+
+	// Amount of metrics from OpenTelemetry receiver.
+	otlp int
+
+	// Amount of metrics from scraped Prometheus endpoints.
+	scrape int
+
+	// Amount of failed scrapes of Prometheus endpoints.
+	scrapeErrors int
+
+	// Amount of files and directories in metricDir, which can not be read.
+	unreadable int
+
+	// Amount of files moved from metricDir to quarantineDir.
+	quarantined int
+
+	// Amount of rates derived from counters.
+	rates int
+
+	// Amount of metrics dropped, because aggregation interval is full.
+	aggrDropped int
+
+	// Amount of aggregated series forwarded to the central grafsy.
+	aggrForwarded int
+
+	// Amount of failed forwards of aggregated series.
+	aggrForwardErrors int
+
+	// Amount of aggregated series dropped after failed forwards.
+	aggrForwardDropped int
+
+	// Amount of aggregated series received from other grafsy instances.
+	aggrMerged int
+
+	// Amount of points consumed by downsampling.
+	downsampled int
+
+	// Amount of points dropped, because their downsampling window was already sent.
+	downsampleLate int
+
+	// Amount of duplicated points suppressed before sending.
+	deduplicated int
+
+	// Amount of metrics with names changed by sanitizer.
+	sanitized int
+
+	// Amount of metrics rejected because of invalid name.
+	rejectedName int
+
+	// Amount of metrics rejected because of invalid value.
+	rejectedValue int
+
+	// Amount of metrics rejected because of invalid timestamp.
+	rejectedTimestamp int
+
+	// Amount of metrics rejected because they are too long.
+	rejectedTooLong int
+
+	// Amount of metrics rejected because they do not match allowedMetrics.
+	rejectedNotAllowed int
+
+	// Amount of metrics with missing timestamps replaced with the time of receiving.
+	timestampFilled int
+
+	// Amount of metrics with timestamps converted to seconds.
+	timestampConverted int
+
+	// Amount of metrics with timestamps clamped to the allowed window.
+	timestampClamped int
+
+	// Amount of metrics rejected because of timestamps outside of the allowed window.
+	timestampRejected int
 }
 
 // The statistic of metrics per backend
@@ -66,11 +160,38 @@ func (m *Monitoring) generateOwnMonitoring() {
 	monitorSlice := []string{
 		fmt.Sprintf("%s.got.net %v %v", path, m.serverStat.net, now),
 		fmt.Sprintf("%s.got.dir %v %v", path, m.serverStat.dir, now),
+		fmt.Sprintf("%s.got.influx %v %v", path, m.serverStat.influx, now),
+		fmt.Sprintf("%s.got.http %v %v", path, m.serverStat.http, now),
+		fmt.Sprintf("%s.got.prometheus %v %v", path, m.serverStat.prometheus, now),
+		fmt.Sprintf("%s.got.otlp %v %v", path, m.serverStat.otlp, now),
+		fmt.Sprintf("%s.got.scrape %v %v", path, m.serverStat.scrape, now),
+		fmt.Sprintf("%s.scrape_errors %v %v", path, m.serverStat.scrapeErrors, now),
 		fmt.Sprintf("%s.invalid %v %v", path, m.serverStat.invalid, now),
+		fmt.Sprintf("%s.dir.unreadable %v %v", path, m.serverStat.unreadable, now),
+		fmt.Sprintf("%s.dir.quarantined %v %v", path, m.serverStat.quarantined, now),
+		fmt.Sprintf("%s.sanitized %v %v", path, m.serverStat.sanitized, now),
+		fmt.Sprintf("%s.deduplicated %v %v", path, m.serverStat.deduplicated, now),
+		fmt.Sprintf("%s.downsampled %v %v", path, m.serverStat.downsampled, now),
+		fmt.Sprintf("%s.downsampled.late %v %v", path, m.serverStat.downsampleLate, now),
+		fmt.Sprintf("%s.rates %v %v", path, m.serverStat.rates, now),
+		fmt.Sprintf("%s.aggr.dropped %v %v", path, m.serverStat.aggrDropped, now),
+		fmt.Sprintf("%s.aggr.forwarded %v %v", path, m.serverStat.aggrForwarded, now),
+		fmt.Sprintf("%s.aggr.forward_errors %v %v", path, m.serverStat.aggrForwardErrors, now),
+		fmt.Sprintf("%s.aggr.forward_dropped %v %v", path, m.serverStat.aggrForwardDropped, now),
+		fmt.Sprintf("%s.aggr.merged %v %v", path, m.serverStat.aggrMerged, now),
+		fmt.Sprintf("%s.rejected.bad_name %v %v", path, m.serverStat.rejectedName, now),
+		fmt.Sprintf("%s.rejected.bad_value %v %v", path, m.serverStat.rejectedValue, now),
+		fmt.Sprintf("%s.rejected.bad_timestamp %v %v", path, m.serverStat.rejectedTimestamp, now),
+		fmt.Sprintf("%s.rejected.too_long %v %v", path, m.serverStat.rejectedTooLong, now),
+		fmt.Sprintf("%s.rejected.not_allowed %v %v", path, m.serverStat.rejectedNotAllowed, now),
+		fmt.Sprintf("%s.timestamp.filled %v %v", path, m.serverStat.timestampFilled, now),
+		fmt.Sprintf("%s.timestamp.converted %v %v", path, m.serverStat.timestampConverted, now),
+		fmt.Sprintf("%s.timestamp.clamped %v %v", path, m.serverStat.timestampClamped, now),
+		fmt.Sprintf("%s.timestamp.rejected %v %v", path, m.serverStat.timestampRejected, now),
 	}
 
 	for _, carbonAddr := range m.Conf.CarbonAddrs {
-		carbonAddrString := strings.Replace(carbonAddr, ".", "_", -1)
+		carbonAddrString := monitoringName(carbonAddr)
 		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.%s.dropped %v %v", path, carbonAddrString, m.clientStat[carbonAddr].dropped, now))
 		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.%s.from_retry %v %v", path, carbonAddrString, m.clientStat[carbonAddr].fromRetry, now))
 		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.%s.saved %v %v", path, carbonAddrString, m.clientStat[carbonAddr].saved, now))
@@ -78,6 +199,42 @@ func (m *Monitoring) generateOwnMonitoring() {
 		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.%s.aggregated %v %v", path, carbonAddrString, m.clientStat[carbonAddr].aggregated, now))
 	}
 
+	for _, rule := range m.Conf.Filter {
+		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.filter.%s %v %v", path, rule.Name, m.filterStat[rule.Name], now))
+	}
+
+	for _, rule := range m.Conf.Overwrite {
+		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.overwrite.%s %v %v", path, rule.Name, m.overwriteStat[rule.Name], now))
+	}
+
+	if m.Lc.cardinality != nil {
+		for _, prefix := range m.Lc.cardinality.top(m.Conf.CardinalityTopN, false) {
+			name := strings.Replace(prefix.Prefix, ".", "_", -1)
+			monitorSlice = append(monitorSlice, fmt.Sprintf("%s.cardinality.%s.series %v %v", path, name, prefix.Series, now))
+			monitorSlice = append(monitorSlice, fmt.Sprintf("%s.cardinality.%s.points %v %v", path, name, prefix.Points, now))
+		}
+	}
+
+	prefixes := make([]string, 0, len(m.limitStat))
+	for prefix := range m.limitStat {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.limit.%s.rate %v %v", path, prefix, m.limitStat[prefix].rate, now))
+		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.limit.%s.series %v %v", path, prefix, m.limitStat[prefix].series, now))
+	}
+
+	sources := make([]string, 0, len(m.dirSourceStat))
+	for source := range m.dirSourceStat {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.dir.source.%s.got %v %v", path, source, m.dirSourceStat[source].got, now))
+		monitorSlice = append(monitorSlice, fmt.Sprintf("%s.dir.source.%s.invalid %v %v", path, source, m.dirSourceStat[source].invalid, now))
+	}
+
 	statLock.Unlock()
 
 	for _, metric := range monitorSlice {
@@ -101,7 +258,14 @@ func (m *Monitoring) clean() {
 		m.clientStat[carbonAddr].sent = 0
 		m.clientStat[carbonAddr].aggregated = 0
 	}
-	m.serverStat = serverStat{0, 0, 0}
+	m.serverStat = serverStat{}
+	m.dirSourceStat = nil
+	m.filterStat = nil
+	m.overwriteStat = nil
+	m.limitStat = nil
+	if m.Lc.cardinality != nil {
+		m.Lc.cardinality.reset()
+	}
 }
 
 // Increase metric value in the thread safe way
@@ -111,6 +275,28 @@ func (m *Monitoring) Increase(metric *int, value int) {
 	statLock.Unlock()
 }
 
+// Increase statistic of the metricDir source in the thread safe way
+func (m *Monitoring) increaseDirSource(source string, got int, invalid int) {
+	statLock.Lock()
+	defer statLock.Unlock()
+	if m.dirSourceStat == nil {
+		m.dirSourceStat = make(map[string]*dirSourceStat)
+	}
+	stat, ok := m.dirSourceStat[source]
+	if !ok {
+		if len(m.dirSourceStat) >= maxDirSources-1 {
+			source = otherDirSource
+			stat = m.dirSourceStat[source]
+		}
+		if stat == nil {
+			stat = &dirSourceStat{}
+			m.dirSourceStat[source] = stat
+		}
+	}
+	stat.got += got
+	stat.invalid += invalid
+}
+
 // Run monitoring.
 // Should be run in separate goroutine.
 func (m *Monitoring) Run() {
@@ -138,3 +324,49 @@ func (m *Monitoring) Run() {
 		statLock.Unlock()
 	}
 }
+
+// Increase hits of the filter rule in the thread safe way
+func (m *Monitoring) increaseFilter(rule string) {
+	statLock.Lock()
+	defer statLock.Unlock()
+	if m.filterStat == nil {
+		m.filterStat = make(map[string]int)
+	}
+	m.filterStat[rule]++
+}
+
+// Increase rewritten metrics of the overwrite rule in the thread safe way
+func (m *Monitoring) increaseOverwrite(rule string) {
+	statLock.Lock()
+	defer statLock.Unlock()
+	if m.overwriteStat == nil {
+		m.overwriteStat = make(map[string]int)
+	}
+	m.overwriteStat[rule]++
+}
+
+// Increase metrics dropped by limiter for the prefix in the thread safe way
+func (m *Monitoring) increaseLimit(prefix string, reason string) {
+	statLock.Lock()
+	defer statLock.Unlock()
+	if m.limitStat == nil {
+		m.limitStat = make(map[string]*limitStat)
+	}
+	stat, ok := m.limitStat[prefix]
+	if !ok {
+		if len(m.limitStat) >= maxLimitPrefixes-1 {
+			prefix = otherLimitPrefix
+			stat = m.limitStat[prefix]
+		}
+		if stat == nil {
+			stat = &limitStat{}
+			m.limitStat[prefix] = stat
+		}
+	}
+	switch reason {
+	case limitRate:
+		stat.rate++
+	case limitSeries:
+		stat.series++
+	}
+}
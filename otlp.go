@@ -0,0 +1,676 @@
+package grafsy
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Default template to convert OpenTelemetry metrics to Graphite path
+const defaultOTLPTemplate = "name"
+
+// Default percentiles calculated for OpenTelemetry histograms
+var defaultOTLPPercentiles = []float64{50, 90, 99}
+
+// Kinds of OpenTelemetry metrics
+const (
+	otlpNumber = iota
+	otlpHistogram
+	otlpSummary
+)
+
+// A data point of OpenTelemetry metric
+type otlpPoint struct {
+	attributes map[string]string
+
+	// Timestamp in nanoseconds
+	timestamp uint64
+
+	// Value of gauge or sum
+	value float64
+
+	// Count and sum of histogram or summary
+	count  uint64
+	sum    float64
+	hasSum bool
+
+	// Histogram buckets: upper bounds and non cumulative counts
+	bounds  []float64
+	buckets []uint64
+
+	min, max       float64
+	hasMin, hasMax bool
+
+	// Summary quantiles in format [quantile, value]
+	quantiles [][2]float64
+}
+
+// OpenTelemetry metric
+type otlpMetric struct {
+	name   string
+	kind   int
+	points []otlpPoint
+
+	// Amount of malformed data points, which were skipped.
+	invalid int
+}
+
+// OpenTelemetry metrics of a resource
+type otlpResource struct {
+	attributes map[string]string
+	metrics    []otlpMetric
+}
+
+// Rules to convert OpenTelemetry metrics to Graphite
+type otlpConverter struct {
+	// Template of Graphite path, "name" is replaced with metric name.
+	template pathTemplate
+
+	// Drop attributes, which are not used in the template, instead of converting them to Graphite tags.
+	dropTags bool
+
+	// Percentiles calculated for histograms.
+	percentiles []float64
+}
+
+// Attribute names with dots can not be used in templates, so dots are replaced with underscores
+func otlpAttributeName(name string) string {
+	return strings.Replace(name, ".", "_", -1)
+}
+
+// Keep dots of OpenTelemetry metric name as Graphite path separators
+func otlpMetricName(name string) string {
+	parts := strings.Split(name, ".")
+	for i := range parts {
+		parts[i] = graphiteSafe(parts[i])
+	}
+	return strings.Join(parts, ".")
+}
+
+// Format percentile as a part of Graphite path, e.g. 99.9 -> p99_9
+func percentileName(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
+
+// Check that every histogram bucket has an upper bound except the last one
+func (p *otlpPoint) valid(kind int) bool {
+	return kind != otlpHistogram || len(p.buckets) == 0 || len(p.buckets) == len(p.bounds)+1
+}
+
+// Add data point to the metric or count it as invalid
+func (m *otlpMetric) add(point otlpPoint) {
+	if !point.valid(m.kind) {
+		m.invalid++
+		return
+	}
+	m.points = append(m.points, point)
+}
+
+// Estimate percentile from histogram buckets with linear interpolation inside of the bucket
+func (p *otlpPoint) percentile(percentile float64) (float64, bool) {
+	if p.count == 0 || len(p.buckets) == 0 {
+		return 0, false
+	}
+	rank := percentile / 100 * float64(p.count)
+	var cumulative float64
+	for i, count := range p.buckets {
+		if count == 0 || cumulative+float64(count) < rank {
+			cumulative += float64(count)
+			continue
+		}
+		lower, upper := math.Inf(-1), math.Inf(1)
+		if i > 0 {
+			lower = p.bounds[i-1]
+		} else if p.hasMin {
+			lower = p.min
+		}
+		if i < len(p.bounds) {
+			upper = p.bounds[i]
+		} else if p.hasMax {
+			upper = p.max
+		}
+		switch {
+		case math.IsInf(lower, 0) && math.IsInf(upper, 0):
+			return 0, false
+		case math.IsInf(lower, 0):
+			return upper, true
+		case math.IsInf(upper, 0):
+			return lower, true
+		}
+		return lower + (upper-lower)*(rank-cumulative)/float64(count), true
+	}
+	return 0, false
+}
+
+// Convert OpenTelemetry metrics to Graphite metrics.
+// Gauges and sums become a single series, histograms and summaries become several series with suffixes.
+func (c *otlpConverter) graphiteMetrics(resources []otlpResource) []string {
+	var metrics []string
+	for _, resource := range resources {
+		for _, metric := range resource.metrics {
+			for _, point := range metric.points {
+				tags := make(map[string]string, len(resource.attributes)+len(point.attributes))
+				for name, value := range resource.attributes {
+					tags[name] = value
+				}
+				for name, value := range point.attributes {
+					tags[name] = value
+				}
+				path, graphiteTags := c.template.build(map[string]string{"name": otlpMetricName(metric.name)}, tags, c.dropTags)
+				if path == "" {
+					continue
+				}
+
+				timestamp := int64(point.timestamp / 1e9)
+				if timestamp == 0 {
+					timestamp = time.Now().Unix()
+				}
+				ts := " " + strconv.FormatInt(timestamp, 10)
+				add := func(suffix string, value float64) {
+					if v, ok := formatGraphiteValue(value); ok {
+						metrics = append(metrics, path+suffix+graphiteTags+" "+v+ts)
+					}
+				}
+
+				switch metric.kind {
+				case otlpNumber:
+					add("", point.value)
+				case otlpHistogram:
+					add(".count", float64(point.count))
+					if point.hasSum {
+						add(".sum", point.sum)
+					}
+					if point.hasMin {
+						add(".min", point.min)
+					}
+					if point.hasMax {
+						add(".max", point.max)
+					}
+					var cumulative uint64
+					for i, count := range point.buckets {
+						cumulative += count
+						le := "inf"
+						if i < len(point.bounds) {
+							le = strings.Replace(strconv.FormatFloat(point.bounds[i], 'f', -1, 64), ".", "_", -1)
+						}
+						add(".bucket.le_"+le, float64(cumulative))
+					}
+					for _, p := range c.percentiles {
+						if value, ok := point.percentile(p); ok {
+							add("."+percentileName(p), value)
+						}
+					}
+				case otlpSummary:
+					add(".count", float64(point.count))
+					add(".sum", point.sum)
+					for _, q := range point.quantiles {
+						add(".quantile."+percentileName(q[0]*100), q[1])
+					}
+				}
+			}
+		}
+	}
+	return metrics
+}
+
+// Decode bytes field of protobuf message
+func protoBytes(b []byte) []byte {
+	v, _ := protowire.ConsumeBytes(b)
+	return v
+}
+
+// Decode double field of protobuf message
+func protoDouble(b []byte) float64 {
+	v, _ := protowire.ConsumeFixed64(b)
+	return math.Float64frombits(v)
+}
+
+// Decode repeated fixed64 field, which can be packed or not
+func protoRepeatedFixed64(typ protowire.Type, b []byte, values []uint64) []uint64 {
+	if typ == protowire.Fixed64Type {
+		v, _ := protowire.ConsumeFixed64(b)
+		return append(values, v)
+	}
+	packed := protoBytes(b)
+	for len(packed) >= 8 {
+		v, n := protowire.ConsumeFixed64(packed)
+		values = append(values, v)
+		packed = packed[n:]
+	}
+	return values
+}
+
+// Decode AnyValue message to string
+func decodeOTLPAnyValue(data []byte) (string, error) {
+	var value string
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		switch num {
+		case 1:
+			value = string(protoBytes(b))
+		case 2:
+			v, _ := protowire.ConsumeVarint(b)
+			value = strconv.FormatBool(v != 0)
+		case 3:
+			v, _ := protowire.ConsumeVarint(b)
+			value = strconv.FormatInt(int64(v), 10)
+		case 4:
+			value = strconv.FormatFloat(protoDouble(b), 'f', -1, 64)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Decode KeyValue message into attributes
+func decodeOTLPAttribute(data []byte, attributes map[string]string) error {
+	var key, value string
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		var err error
+		switch num {
+		case 1:
+			key = string(protoBytes(b))
+		case 2:
+			value, err = decodeOTLPAnyValue(protoBytes(b))
+		}
+		return err
+	})
+	if key != "" && value != "" {
+		attributes[otlpAttributeName(key)] = value
+	}
+	return err
+}
+
+// Decode NumberDataPoint, HistogramDataPoint or SummaryDataPoint message
+func decodeOTLPPoint(data []byte, kind int) (otlpPoint, error) {
+	point := otlpPoint{attributes: make(map[string]string)}
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		// Attributes have different numbers in different points
+		if (kind == otlpHistogram && num == 9) || (kind != otlpHistogram && num == 7) {
+			return decodeOTLPAttribute(protoBytes(b), point.attributes)
+		}
+		switch {
+		case num == 3:
+			point.timestamp, _ = protowire.ConsumeFixed64(b)
+		case kind == otlpNumber && num == 4:
+			point.value = protoDouble(b)
+		case kind == otlpNumber && num == 6:
+			v, _ := protowire.ConsumeFixed64(b)
+			point.value = float64(int64(v))
+		case kind != otlpNumber && num == 4:
+			point.count, _ = protowire.ConsumeFixed64(b)
+		case kind != otlpNumber && num == 5:
+			point.sum, point.hasSum = protoDouble(b), true
+		case kind == otlpHistogram && num == 6:
+			point.buckets = protoRepeatedFixed64(typ, b, point.buckets)
+		case kind == otlpHistogram && num == 7:
+			for _, v := range protoRepeatedFixed64(typ, b, nil) {
+				point.bounds = append(point.bounds, math.Float64frombits(v))
+			}
+		case kind == otlpHistogram && num == 11:
+			point.min, point.hasMin = protoDouble(b), true
+		case kind == otlpHistogram && num == 12:
+			point.max, point.hasMax = protoDouble(b), true
+		case kind == otlpSummary && num == 6:
+			var q [2]float64
+			err := protoFields(protoBytes(b), func(num protowire.Number, typ protowire.Type, b []byte) error {
+				if num == 1 || num == 2 {
+					q[num-1] = protoDouble(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			point.quantiles = append(point.quantiles, q)
+		}
+		return nil
+	})
+	return point, err
+}
+
+// Decode Metric message.
+// Exponential histograms are not supported and skipped.
+func decodeOTLPMetric(data []byte) (otlpMetric, error) {
+	var metric otlpMetric
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		switch num {
+		case 1:
+			metric.name = string(protoBytes(b))
+			return nil
+		case 5, 7:
+			metric.kind = otlpNumber
+		case 9:
+			metric.kind = otlpHistogram
+		case 11:
+			metric.kind = otlpSummary
+		default:
+			return nil
+		}
+		// Gauge, Sum, Histogram and Summary have data points in the first field
+		return protoFields(protoBytes(b), func(num protowire.Number, typ protowire.Type, b []byte) error {
+			if num != 1 {
+				return nil
+			}
+			point, err := decodeOTLPPoint(protoBytes(b), metric.kind)
+			if err != nil {
+				return err
+			}
+			metric.add(point)
+			return nil
+		})
+	})
+	return metric, err
+}
+
+// Decode ResourceMetrics message
+func decodeOTLPResource(data []byte) (otlpResource, error) {
+	resource := otlpResource{attributes: make(map[string]string)}
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		switch num {
+		case 1:
+			// Resource
+			return protoFields(protoBytes(b), func(num protowire.Number, typ protowire.Type, b []byte) error {
+				if num != 1 {
+					return nil
+				}
+				return decodeOTLPAttribute(protoBytes(b), resource.attributes)
+			})
+		case 2:
+			// ScopeMetrics
+			return protoFields(protoBytes(b), func(num protowire.Number, typ protowire.Type, b []byte) error {
+				if num != 2 {
+					return nil
+				}
+				metric, err := decodeOTLPMetric(protoBytes(b))
+				if err != nil {
+					return err
+				}
+				resource.metrics = append(resource.metrics, metric)
+				return nil
+			})
+		}
+		return nil
+	})
+	return resource, err
+}
+
+// Decode ExportMetricsServiceRequest message
+func decodeOTLPRequest(data []byte) ([]otlpResource, error) {
+	var resources []otlpResource
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		resource, err := decodeOTLPResource(protoBytes(b))
+		if err != nil {
+			return err
+		}
+		resources = append(resources, resource)
+		return nil
+	})
+	return resources, err
+}
+
+// OTLP JSON encoding of AnyValue
+type otlpJSONValue struct {
+	StringValue *string      `json:"stringValue"`
+	BoolValue   *bool        `json:"boolValue"`
+	IntValue    *json.Number `json:"intValue"`
+	DoubleValue *float64     `json:"doubleValue"`
+}
+
+// OTLP JSON encoding of KeyValue
+type otlpJSONAttribute struct {
+	Key   string        `json:"key"`
+	Value otlpJSONValue `json:"value"`
+}
+
+// OTLP JSON encoding of repeated KeyValue
+type otlpJSONAttributes []otlpJSONAttribute
+
+// OTLP JSON encoding of data points
+type otlpJSONPoint struct {
+	Attributes     otlpJSONAttributes `json:"attributes"`
+	TimeUnixNano   json.Number        `json:"timeUnixNano"`
+	AsDouble       *float64           `json:"asDouble"`
+	AsInt          *json.Number       `json:"asInt"`
+	Count          json.Number        `json:"count"`
+	Sum            *float64           `json:"sum"`
+	BucketCounts   []json.Number      `json:"bucketCounts"`
+	ExplicitBounds []float64          `json:"explicitBounds"`
+	Min            *float64           `json:"min"`
+	Max            *float64           `json:"max"`
+	QuantileValues []struct {
+		Quantile float64 `json:"quantile"`
+		Value    float64 `json:"value"`
+	} `json:"quantileValues"`
+}
+
+// OTLP JSON encoding of Gauge, Sum, Histogram and Summary
+type otlpJSONData struct {
+	DataPoints []otlpJSONPoint `json:"dataPoints"`
+}
+
+// OTLP JSON encoding of ExportMetricsServiceRequest
+type otlpJSONRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes otlpJSONAttributes `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []struct {
+				Name      string        `json:"name"`
+				Gauge     *otlpJSONData `json:"gauge"`
+				Sum       *otlpJSONData `json:"sum"`
+				Histogram *otlpJSONData `json:"histogram"`
+				Summary   *otlpJSONData `json:"summary"`
+			} `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+// Convert OTLP JSON attributes to map
+func (attrs otlpJSONAttributes) toMap() map[string]string {
+	result := make(map[string]string, len(attrs))
+	for _, attr := range attrs {
+		var value string
+		switch v := attr.Value; {
+		case v.StringValue != nil:
+			value = *v.StringValue
+		case v.BoolValue != nil:
+			value = strconv.FormatBool(*v.BoolValue)
+		case v.IntValue != nil:
+			value = v.IntValue.String()
+		case v.DoubleValue != nil:
+			value = strconv.FormatFloat(*v.DoubleValue, 'f', -1, 64)
+		}
+		if attr.Key != "" && value != "" {
+			result[otlpAttributeName(attr.Key)] = value
+		}
+	}
+	return result
+}
+
+// Parse unsigned integer encoded as JSON string or number
+func otlpJSONUint(n json.Number) uint64 {
+	v, err := strconv.ParseUint(n.String(), 10, 64)
+	if err != nil {
+		f, _ := n.Float64()
+		return uint64(f)
+	}
+	return v
+}
+
+// Convert OTLP JSON data point
+func (p *otlpJSONPoint) point() otlpPoint {
+	point := otlpPoint{
+		attributes: p.Attributes.toMap(),
+		timestamp:  otlpJSONUint(p.TimeUnixNano),
+		count:      otlpJSONUint(p.Count),
+		bounds:     p.ExplicitBounds,
+	}
+	switch {
+	case p.AsDouble != nil:
+		point.value = *p.AsDouble
+	case p.AsInt != nil:
+		point.value, _ = p.AsInt.Float64()
+	}
+	if p.Sum != nil {
+		point.sum, point.hasSum = *p.Sum, true
+	}
+	if p.Min != nil {
+		point.min, point.hasMin = *p.Min, true
+	}
+	if p.Max != nil {
+		point.max, point.hasMax = *p.Max, true
+	}
+	for _, count := range p.BucketCounts {
+		point.buckets = append(point.buckets, otlpJSONUint(count))
+	}
+	for _, q := range p.QuantileValues {
+		point.quantiles = append(point.quantiles, [2]float64{q.Quantile, q.Value})
+	}
+	return point
+}
+
+// Decode ExportMetricsServiceRequest in OTLP JSON encoding
+func decodeOTLPJSONRequest(data []byte) ([]otlpResource, error) {
+	var request otlpJSONRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+
+	var resources []otlpResource
+	for _, rm := range request.ResourceMetrics {
+		resource := otlpResource{attributes: rm.Resource.Attributes.toMap()}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				metric := otlpMetric{name: m.Name}
+				var data *otlpJSONData
+				switch {
+				case m.Gauge != nil:
+					data = m.Gauge
+				case m.Sum != nil:
+					data = m.Sum
+				case m.Histogram != nil:
+					metric.kind, data = otlpHistogram, m.Histogram
+				case m.Summary != nil:
+					metric.kind, data = otlpSummary, m.Summary
+				default:
+					continue
+				}
+				for i := range data.DataPoints {
+					metric.add(data.DataPoints[i].point())
+				}
+				resource.metrics = append(resource.metrics, metric)
+			}
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// Receive OTLP/HTTP metrics in protobuf or JSON encoding
+func (s *Server) handleOTLPMetrics(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json"
+	respond := func(status int, message string) {
+		if isJSON {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "application/x-protobuf")
+		}
+		w.WriteHeader(status)
+		// Empty ExportMetricsServiceResponse or google.rpc.Status with message
+		switch {
+		case isJSON && message == "":
+			w.Write([]byte("{}"))
+		case isJSON:
+			json.NewEncoder(w).Encode(map[string]string{"message": message})
+		case message != "":
+			w.Write(protowire.AppendBytes(protowire.AppendTag(nil, 2, protowire.BytesType), []byte(message)))
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		respond(http.StatusMethodNotAllowed, "only POST is allowed")
+		return
+	}
+	if s.queueFull() {
+		respond(http.StatusTooManyRequests, "queue is full")
+		return
+	}
+
+	body, err := httpRequestBody(w, r)
+	if err != nil {
+		respond(http.StatusBadRequest, err.Error())
+		return
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		respond(httpBodyErrorStatus(err), err.Error())
+		return
+	}
+
+	var resources []otlpResource
+	if isJSON {
+		resources, err = decodeOTLPJSONRequest(data)
+	} else {
+		resources, err = decodeOTLPRequest(data)
+	}
+	if err != nil {
+		respond(http.StatusBadRequest, errors.Wrap(err, "can not decode ExportMetricsServiceRequest").Error())
+		return
+	}
+
+	invalid := 0
+	for _, resource := range resources {
+		for _, metric := range resource.metrics {
+			invalid += metric.invalid
+		}
+	}
+	if invalid > 0 {
+		s.Lc.lg.Printf("Removing %d malformed OTLP data points", invalid)
+		s.Mon.Increase(&s.Mon.serverStat.invalid, invalid)
+	}
+
+	metrics := s.Lc.otlpConverter.graphiteMetrics(resources)
+	s.Mon.Increase(&s.Mon.serverStat.otlp, len(metrics))
+	stat := s.cleanAndUseIncomingData(metrics)
+	if stat.dropped == 0 {
+		respond(http.StatusOK, "")
+		return
+	}
+	// Exporters retry the whole request on 429, so it is returned only if nothing is enqueued
+	if stat.accepted == 0 {
+		respond(http.StatusTooManyRequests, "queue is full")
+		return
+	}
+	// ExportMetricsServiceResponse with partial_success
+	message := "queue is full, some metrics were dropped"
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]map[string]string{"partialSuccess": {
+			"rejectedDataPoints": strconv.Itoa(stat.dropped),
+			"errorMessage":       message,
+		}})
+		return
+	}
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(stat.dropped))
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendBytes(partial, []byte(message))
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), partial))
+}
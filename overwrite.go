@@ -0,0 +1,72 @@
+package grafsy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Actions of overwrite rules
+const (
+	overwriteReplace  = "replace"
+	overwriteLower    = "lower"
+	overwriteUpper    = "upper"
+	overwriteSanitize = "sanitize"
+)
+
+// Replace characters other than letters, digits, "-", "_" and "." with replacement
+func sanitizeChars(s string, replacement string) string {
+	var result strings.Builder
+	for _, r := range s {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			result.WriteRune(r)
+		} else {
+			result.WriteString(replacement)
+		}
+	}
+	return result.String()
+}
+
+// Sanitize name of metric in format <name>[;tag=value...] <value> <timestamp>:
+//  1. Whitespaces inside the name are replaced with "_", the last 2 fields are treated as value and timestamp.
+//  2. Characters matching disallowed in the path and tags are replaced with "_".
+//  3. Duplicate dots are collapsed, leading and trailing dots are removed.
+//  4. Nodes of the path longer than maxNodeLength are trimmed, 0 means no limit.
+//
+// Return the metric and whether its name was changed.
+func sanitizeMetric(metric string, maxNodeLength int, disallowed *regexp.Regexp) (string, bool) {
+	fields := strings.Fields(metric)
+	if len(fields) == 0 {
+		return metric, false
+	}
+	// Repeated whitespaces between fields are not counted as a change
+	original := strings.Join(fields, " ")
+	rest := ""
+	if len(fields) > 3 {
+		rest = " " + strings.Join(fields[len(fields)-2:], " ")
+		fields = []string{strings.Join(fields[:len(fields)-2], "_")}
+	} else if len(fields) > 1 {
+		rest = " " + strings.Join(fields[1:], " ")
+	}
+
+	nameAndTags := strings.Split(fields[0], ";")
+	nodes := strings.Split(disallowed.ReplaceAllString(nameAndTags[0], "_"), ".")
+	path := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node == "" {
+			continue
+		}
+		if maxNodeLength > 0 && len(node) > maxNodeLength {
+			node = node[:maxNodeLength]
+		}
+		path = append(path, node)
+	}
+	nameAndTags[0] = strings.Join(path, ".")
+	for i, tag := range nameAndTags[1:] {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+			nameAndTags[i+1] = disallowed.ReplaceAllString(kv[0], "_") + "=" + disallowed.ReplaceAllString(kv[1], "_")
+		}
+	}
+
+	result := strings.Join(nameAndTags, ";") + rest
+	return result, result != original
+}
@@ -0,0 +1,363 @@
+package grafsy
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Default template to convert Prometheus labels to Graphite path
+const defaultPromTemplate = "name"
+
+// Label of Prometheus series with metric name
+const promNameLabel = "__name__"
+
+// A sample of Prometheus time series
+type promSample struct {
+	value float64
+
+	// Timestamp in milliseconds
+	timestamp int64
+}
+
+// Prometheus time series
+type promSeries struct {
+	labels  map[string]string
+	samples []promSample
+}
+
+// Rules to convert Prometheus series to Graphite
+type promConverter struct {
+	// Template of Graphite path, "name" is replaced with __name__ label.
+	template pathTemplate
+
+	// Drop labels, which are not used in the template, instead of converting them to Graphite tags.
+	dropTags bool
+}
+
+// Format value as Graphite does not support NaN and Inf.
+func formatGraphiteValue(value float64) (string, bool) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", false
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64), true
+}
+
+// Convert Prometheus series to Graphite metrics in format <path>;tag=value <value> <timestamp>.
+// Samples with NaN (e.g. stale markers) and Inf values are skipped.
+func (c *promConverter) graphiteMetrics(series *promSeries) []string {
+	labels := make(map[string]string, len(series.labels))
+	for name, value := range series.labels {
+		if name != promNameLabel {
+			labels[name] = value
+		}
+	}
+	path, tags := c.template.build(map[string]string{"name": graphiteSafe(series.labels[promNameLabel])}, labels, c.dropTags)
+	if path == "" {
+		return nil
+	}
+
+	metrics := make([]string, 0, len(series.samples))
+	for _, sample := range series.samples {
+		value, ok := formatGraphiteValue(sample.value)
+		if !ok {
+			continue
+		}
+		metrics = append(metrics, path+tags+" "+value+" "+strconv.FormatInt(sample.timestamp/1000, 10))
+	}
+	return metrics
+}
+
+// Iterate over fields of protobuf message
+func protoFields(data []byte, field func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		m := protowire.ConsumeFieldValue(num, typ, data)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		if err := field(num, typ, data[:m]); err != nil {
+			return err
+		}
+		data = data[m:]
+	}
+	return nil
+}
+
+// Decode prometheus.Label message
+func decodePromLabel(data []byte) (string, string, error) {
+	var name, value string
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		v, _ := protowire.ConsumeBytes(b)
+		switch num {
+		case 1:
+			name = string(v)
+		case 2:
+			value = string(v)
+		}
+		return nil
+	})
+	return name, value, err
+}
+
+// Decode prometheus.Sample message
+func decodePromSample(data []byte) (promSample, error) {
+	var sample promSample
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, _ := protowire.ConsumeFixed64(b)
+			sample.value = math.Float64frombits(v)
+		case num == 2 && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(b)
+			sample.timestamp = int64(v)
+		}
+		return nil
+	})
+	return sample, err
+}
+
+// Decode prometheus.TimeSeries message
+func decodePromSeries(data []byte) (*promSeries, error) {
+	series := &promSeries{labels: make(map[string]string)}
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		v, _ := protowire.ConsumeBytes(b)
+		switch num {
+		case 1:
+			name, value, err := decodePromLabel(v)
+			if err != nil {
+				return err
+			}
+			series.labels[name] = value
+		case 2:
+			sample, err := decodePromSample(v)
+			if err != nil {
+				return err
+			}
+			series.samples = append(series.samples, sample)
+		}
+		return nil
+	})
+	return series, err
+}
+
+// Decode prometheus.WriteRequest message.
+// Metadata and native histograms are ignored.
+func decodePromWriteRequest(data []byte) ([]*promSeries, error) {
+	var result []*promSeries
+	err := protoFields(data, func(num protowire.Number, typ protowire.Type, b []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		v, _ := protowire.ConsumeBytes(b)
+		series, err := decodePromSeries(v)
+		if err != nil {
+			return err
+		}
+		result = append(result, series)
+		return nil
+	})
+	return result, err
+}
+
+// Receive Prometheus remote_write requests: snappy compressed protobuf WriteRequest
+func (s *Server) handlePromWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.queueFull() {
+		http.Error(w, "queue is full", http.StatusTooManyRequests)
+		return
+	}
+
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, httpMaxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), httpBodyErrorStatus(err))
+		return
+	}
+	// Check the declared size before decoding to not allocate whatever is declared
+	size, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		http.Error(w, "can not decompress body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if size > httpMaxBodySize {
+		http.Error(w, "decompressed body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, "can not decompress body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	allSeries, err := decodePromWriteRequest(data)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "can not decode WriteRequest").Error(), http.StatusBadRequest)
+		return
+	}
+
+	var metrics []string
+	for _, series := range allSeries {
+		metrics = append(metrics, s.Lc.promConverter.graphiteMetrics(series)...)
+	}
+	s.Mon.Increase(&s.Mon.serverStat.prometheus, len(metrics))
+	// Prometheus retries the whole request on 429, so it is returned only if nothing is enqueued
+	if stat := s.cleanAndUseIncomingData(metrics); stat.dropped > 0 && stat.accepted == 0 {
+		http.Error(w, "queue is full", http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Replace characters, which are not allowed in Prometheus metric and label names, with underscores.
+func promSafe(name string, allowColon bool) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || (allowColon && r == ':') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Convert Graphite metric in format <path>;tag=value <value> <timestamp> to Prometheus labels and sample.
+// Nodes of the path are mapped to labels by template parts, "_" skips a node
+// and "name" takes all nodes, which are not mapped, as the metric name joined by underscores.
+// If the path is shorter than the template, the whole path becomes the metric name.
+func graphiteToProm(metric string, template pathTemplate) (map[string]string, promSample, bool) {
+	split := strings.Fields(metric)
+	if len(split) != 3 {
+		return nil, promSample{}, false
+	}
+	value, err := strconv.ParseFloat(split[1], 64)
+	if err != nil {
+		return nil, promSample{}, false
+	}
+	timestamp, err := strconv.ParseInt(split[2], 10, 64)
+	if err != nil {
+		return nil, promSample{}, false
+	}
+
+	pathAndTags := strings.Split(split[0], ";")
+	labels := make(map[string]string)
+	for _, tag := range pathAndTags[1:] {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 && kv[0] != "" {
+			labels[promSafe(kv[0], false)] = kv[1]
+		}
+	}
+
+	nodes := strings.Split(pathAndTags[0], ".")
+	nameIndex := -1
+	for i, part := range template {
+		if part == "name" {
+			nameIndex = i
+		}
+	}
+	if nameIndex < 0 || len(nodes) < len(template) {
+		labels[promNameLabel] = promSafe(strings.Join(nodes, "_"), true)
+	} else {
+		tail := len(template) - nameIndex - 1
+		for i, part := range template[:nameIndex] {
+			if part != "_" {
+				labels[promSafe(part, false)] = nodes[i]
+			}
+		}
+		for i, part := range template[nameIndex+1:] {
+			if part != "_" {
+				labels[promSafe(part, false)] = nodes[len(nodes)-tail+i]
+			}
+		}
+		labels[promNameLabel] = promSafe(strings.Join(nodes[nameIndex:len(nodes)-tail], "_"), true)
+	}
+	return labels, promSample{value: value, timestamp: timestamp * 1000}, true
+}
+
+// Encode prometheus.WriteRequest message. Labels of series are sorted by names.
+func encodePromWriteRequest(allSeries []*promSeries) []byte {
+	var data []byte
+	for _, series := range allSeries {
+		names := make([]string, 0, len(series.labels))
+		for name := range series.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var ts []byte
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, series.labels[name])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		for _, sample := range series.samples {
+			var s []byte
+			s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+			s = protowire.AppendFixed64(s, math.Float64bits(sample.value))
+			s = protowire.AppendTag(s, 2, protowire.VarintType)
+			s = protowire.AppendVarint(s, uint64(sample.timestamp))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, s)
+		}
+		data = protowire.AppendTag(data, 1, protowire.BytesType)
+		data = protowire.AppendBytes(data, ts)
+	}
+	return data
+}
+
+// Convert Graphite metrics to Prometheus series.
+// Samples of the same series are grouped and sorted by timestamp.
+// Return series and amount of metrics, which can not be converted.
+func graphiteToPromSeries(metrics []string, template pathTemplate) ([]*promSeries, int) {
+	var result []*promSeries
+	seriesByKey := make(map[string]*promSeries)
+	invalid := 0
+	for _, metric := range metrics {
+		labels, sample, ok := graphiteToProm(metric, template)
+		if !ok {
+			invalid++
+			continue
+		}
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var key strings.Builder
+		for _, name := range names {
+			key.WriteString(name + "\x00" + labels[name] + "\x00")
+		}
+
+		series, ok := seriesByKey[key.String()]
+		if !ok {
+			series = &promSeries{labels: labels}
+			seriesByKey[key.String()] = series
+			result = append(result, series)
+		}
+		series.samples = append(series.samples, sample)
+	}
+	for _, series := range result {
+		sort.SliceStable(series.samples, func(i, j int) bool { return series.samples[i].timestamp < series.samples[j].timestamp })
+	}
+	return result, invalid
+}
@@ -0,0 +1,128 @@
+package grafsy
+
+import (
+	"regexp"
+	"sync"
+)
+
+// Default template of the name of derived rate
+const defaultRateOutput = "$0.rate"
+
+// Default maximum gap between points of a counter to derive a rate. In seconds.
+const defaultRateMaxGap = 600
+
+// Compiled rule of counter to rate derivation
+type rateRule struct {
+	re *regexp.Regexp
+
+	// Template of the name of rate with submatches of re.
+	output string
+
+	// Maximum value of the counter before wraparound, 0 means the counter does not wrap.
+	maxValue float64
+
+	// Send the counter itself as well.
+	keep bool
+}
+
+// The previous point of a counter
+type counterPoint struct {
+	value     float64
+	timestamp int64
+}
+
+// Deriver of per-second rates from monotonically increasing counters
+type rateDeriver struct {
+	mu    sync.Mutex
+	rules []*rateRule
+
+	// Maximum gap between points of a counter. In seconds.
+	maxGap int64
+
+	// Maximum amount of counters in memory. Counters over the limit are sent as is.
+	maxCounters int
+
+	// Previous points by name of counter.
+	counters map[string]counterPoint
+}
+
+// Create rate deriver from config. Return nil if there are no rules.
+func (conf *Config) generateRateDeriver() *rateDeriver {
+	if len(conf.Rate) == 0 {
+		return nil
+	}
+	d := &rateDeriver{
+		maxGap:      int64(conf.RateMaxGap),
+		maxCounters: conf.AggrPerSecond * conf.AggrInterval,
+		counters:    make(map[string]counterPoint),
+	}
+	for _, rule := range conf.Rate {
+		d.rules = append(d.rules, &rateRule{
+			re:       regexp.MustCompile(rule.Regexp),
+			output:   rule.Output,
+			maxValue: rule.MaxValue,
+			keep:     rule.Keep,
+		})
+	}
+	return d
+}
+
+// Increase of the counter between 2 points.
+// A decrease is a wraparound if the previous value was in the upper half of maxValue, otherwise it is a reset.
+func (r *rateRule) increase(prev float64, value float64) float64 {
+	if value >= prev {
+		return value - prev
+	}
+	if r.maxValue > 0 && prev > r.maxValue/2 && prev <= r.maxValue {
+		return r.maxValue - prev + value + 1
+	}
+	// The counter was reset and started from 0
+	return value
+}
+
+// Derive the rate of metric if it matches any rule.
+// Return the rate (if it can be calculated), whether metric matches any rule and whether metric itself must be sent.
+func (d *rateDeriver) derive(m Metric) (*Metric, bool, bool) {
+	var rule *rateRule
+	var match []int
+	for _, r := range d.rules {
+		if match = r.re.FindStringSubmatchIndex(m.Path); match != nil {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		return nil, false, true
+	}
+	name := m.Name()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev, ok := d.counters[name]
+	if !ok && len(d.counters) >= d.maxCounters {
+		// Forget counters, which are not updated for too long
+		for counter, point := range d.counters {
+			if m.Timestamp-point.timestamp > d.maxGap {
+				delete(d.counters, counter)
+			}
+		}
+		if len(d.counters) >= d.maxCounters {
+			return nil, false, true
+		}
+	}
+	if ok && m.Timestamp <= prev.timestamp {
+		// Points out of order are ignored
+		return nil, true, rule.keep
+	}
+	d.counters[name] = counterPoint{value: m.Value, timestamp: m.Timestamp}
+	if !ok || m.Timestamp-prev.timestamp > d.maxGap {
+		return nil, true, rule.keep
+	}
+
+	return &Metric{
+		Path:      string(rule.re.ExpandString(nil, rule.output, m.Path, match)),
+		Tags:      m.Tags,
+		Value:     rule.increase(prev.value, m.Value) / float64(m.Timestamp-prev.timestamp),
+		Timestamp: m.Timestamp,
+	}, true, rule.keep
+}
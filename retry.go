@@ -0,0 +1,183 @@
+package grafsy
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Prefix of temporary files in RetryDir, they are not backends
+const retryTmpPrefix = "."
+
+// RetryFileInfo describes the backlog of a single backend in RetryDir.
+type RetryFileInfo struct {
+	// Backend is the name of the carbon receiver, which is also the name of the file.
+	Backend string
+
+	// Path is the full path to the retry file.
+	Path string
+
+	// Amount of lines in the file.
+	Lines int
+
+	// Amount of lines without a parsable timestamp.
+	Invalid int
+
+	// The oldest and the newest timestamps of the metrics in the file.
+	Oldest, Newest time.Time
+}
+
+// metricTimestamp returns the timestamp of the metric in format <name> <value> <timestamp>
+func metricTimestamp(metric string) (int64, bool) {
+	split := strings.Fields(metric)
+	if len(split) < 3 {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(split[len(split)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ts, true
+}
+
+// StatRetryFile reads the retry file and collects information about its backlog.
+func StatRetryFile(file string) (RetryFileInfo, error) {
+	info := RetryFileInfo{
+		Backend: path.Base(file),
+		Path:    file,
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	var oldest, newest int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		info.Lines++
+		ts, ok := metricTimestamp(scanner.Text())
+		if !ok {
+			info.Invalid++
+			continue
+		}
+		if oldest == 0 || ts < oldest {
+			oldest = ts
+		}
+		if ts > newest {
+			newest = ts
+		}
+	}
+	if oldest != 0 {
+		info.Oldest = time.Unix(oldest, 0)
+		info.Newest = time.Unix(newest, 0)
+	}
+	return info, scanner.Err()
+}
+
+// ListRetryFiles returns the backlog information of every backend in retryDir sorted by the backend name.
+func ListRetryFiles(retryDir string) ([]RetryFileInfo, error) {
+	entries, err := os.ReadDir(retryDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []RetryFileInfo
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), retryTmpPrefix) {
+			continue
+		}
+		info, err := StatRetryFile(path.Join(retryDir, entry.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "Can not read retry file "+entry.Name())
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Backend < result[j].Backend })
+	return result, nil
+}
+
+// ReadRetryFile reads all metrics from the retry file without removing it.
+func ReadRetryFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readLines(f)
+}
+
+// WriteRetryFile replaces the content of the retry file with metrics.
+// The file is removed if there are no metrics left.
+func WriteRetryFile(file string, metrics []string) error {
+	if len(metrics) == 0 {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	tmpFile := path.Join(path.Dir(file), retryTmpPrefix+path.Base(file)+".tmp")
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, metric := range metrics {
+		w.WriteString(metric + "\n")
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// RetryFileName returns the name of the retry file for the backend.
+// Slashes of URLs of HTTP backends are replaced with underscores.
+func RetryFileName(carbonAddr string) string {
+	return strings.NewReplacer("://", "_", "/", "_").Replace(carbonAddr)
+}
+
+// MoveRetryFile appends the backlog of the backend "from" to the backlog of the backend "to"
+// and removes the source file afterwards.
+func MoveRetryFile(retryDir, from, to string) error {
+	if from == to {
+		return errors.New("Source and destination backends are the same")
+	}
+	srcFile := path.Join(retryDir, RetryFileName(from))
+	metrics, err := ReadRetryFile(srcFile)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(path.Join(retryDir, RetryFileName(to)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(dst)
+	for _, metric := range metrics {
+		w.WriteString(metric + "\n")
+	}
+	if err = w.Flush(); err != nil {
+		dst.Close()
+		return errors.Wrap(err, "Can not write to "+to)
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(srcFile)
+}
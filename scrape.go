@@ -0,0 +1,164 @@
+package grafsy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Parse labels of Prometheus text exposition format: {name="value",...}
+// Return labels and the rest of the line after closing brace.
+func parsePromLabels(s string, labels map[string]string) (string, error) {
+	s = strings.TrimLeft(s, " \t")
+	for {
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return "", errors.New("invalid labels")
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return "", errors.New("label value of " + name + " is not quoted")
+		}
+
+		var value strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return "", errors.New("label value of " + name + " is not closed")
+		}
+		labels[name] = value.String()
+
+		s = strings.TrimLeft(s[i+1:], " \t")
+		s = strings.TrimPrefix(s, ",")
+		s = strings.TrimLeft(s, " \t")
+	}
+}
+
+// Parse a line of Prometheus text exposition format:
+// metric_name[{label="value",...}] value [timestamp]
+// Timestamp in milliseconds is set to defaultTimestamp if it is missing.
+func parsePromTextLine(line string, defaultTimestamp int64) (*promSeries, error) {
+	series := &promSeries{labels: make(map[string]string)}
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return nil, errors.New("invalid line")
+	}
+	series.labels[promNameLabel] = line[:end]
+	rest := line[end:]
+	if rest[0] == '{' {
+		var err error
+		rest, err = parsePromLabels(rest[1:], series.labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, errors.New("invalid amount of fields")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, errors.New("invalid value " + fields[0])
+	}
+	sample := promSample{value: value, timestamp: defaultTimestamp}
+	if len(fields) == 2 {
+		sample.timestamp, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid timestamp " + fields[1])
+		}
+	}
+	series.samples = []promSample{sample}
+	return series, nil
+}
+
+// Convert Prometheus text exposition format to Graphite metrics.
+// Return converted metrics and amount of lines which can not be parsed.
+func (c *promConverter) convertText(r io.Reader, prefix string, defaultTimestamp int64) ([]string, int, error) {
+	var metrics []string
+	invalid := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, err := parsePromTextLine(line, defaultTimestamp)
+		if err != nil {
+			invalid++
+			continue
+		}
+		for _, metric := range c.graphiteMetrics(series) {
+			metrics = append(metrics, prefix+metric)
+		}
+	}
+	return metrics, invalid, scanner.Err()
+}
+
+// Scrape Prometheus exposition endpoint once
+func (s *Server) scrape(client *http.Client, target ScrapeTarget, converter *promConverter, prefix string) error {
+	req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status " + resp.Status)
+	}
+
+	metrics, invalid, err := converter.convertText(io.LimitReader(resp.Body, httpMaxBodySize), prefix, time.Now().UnixNano()/1e6)
+	if invalid > 0 {
+		s.Mon.Increase(&s.Mon.serverStat.invalid, invalid)
+	}
+	s.Mon.Increase(&s.Mon.serverStat.scrape, len(metrics)+invalid)
+	s.cleanAndUseIncomingData(metrics)
+	return err
+}
+
+// Scrape Prometheus exposition endpoint every interval
+func (s *Server) handleScrape(target ScrapeTarget) {
+	converter := s.Lc.promConverter
+	if target.Template != "" {
+		converter = &promConverter{
+			template: parsePathTemplate(target.Template),
+			dropTags: s.Conf.PromDropTags,
+		}
+	}
+	prefix := strings.Replace(target.Prefix, "HOSTNAME", s.Lc.hostname, -1)
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	client := &http.Client{Timeout: time.Duration(target.Timeout) * time.Second}
+
+	for ; ; time.Sleep(time.Duration(target.Interval) * time.Second) {
+		err := s.scrape(client, target, converter, prefix)
+		if err != nil {
+			s.Lc.lg.Printf("Failed to scrape %s: %s", target.URL, err.Error())
+			s.Mon.Increase(&s.Mon.serverStat.scrapeErrors, 1)
+		}
+	}
+}
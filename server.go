@@ -5,12 +5,19 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Amount of rejected metrics for sampling of logs
+var rejectedMetrics uint64
+
+// Files of metricDir, which were already reported as unreadable
+var unreadableFiles sync.Map
+
 // The Server class to receive a data
 type Server struct {
 	// User config.
@@ -24,68 +31,27 @@ type Server struct {
 }
 
 // Aggregate metrics with prefix.
+// Save the state of aggregation every AggrStateInterval if AggrStateFile is set.
 func (s Server) aggrMetricsWithPrefix() {
-	for ; ; time.Sleep(time.Duration(s.Conf.AggrInterval) * time.Second) {
-		// We assume, that aggregation is done for a current point in time
-		aggrTimestamp := time.Now().Unix()
-
-		workingList := make(map[string]*metricData)
-		chanSize := len(s.Lc.aggrChannel)
-		for i := 0; i < chanSize; i++ {
-			split := strings.Fields(<-s.Lc.aggrChannel)
-			metricName := split[0]
-
-			value, err := strconv.ParseFloat(split[1], 64)
-			if err != nil {
-				s.Lc.lg.Println("Can not parse value of metric ", metricName, ": ", split[1])
-				continue
-			}
-
-			_, metricExist := workingList[metricName]
-			if !metricExist {
-				workingList[metricName] = &metricData{}
-			}
+	nextSave := time.Now().Unix() + int64(s.Conf.AggrStateInterval)
+	for ; ; time.Sleep(time.Second) {
+		now := time.Now().Unix()
+		s.drainAggrChannel()
+		sent := s.Lc.aggregator.lastSent()
 
-			if strings.HasPrefix(metricName, s.Conf.SumPrefix) {
-				workingList[metricName].value += value
-			} else if strings.HasPrefix(metricName, s.Conf.AvgPrefix) {
-				workingList[metricName].value += value
-				workingList[metricName].amount++
-			} else if strings.HasPrefix(metricName, s.Conf.MinPrefix) {
-				if !metricExist {
-					workingList[metricName].value = value
-				} else if workingList[metricName].value > value {
-					workingList[metricName].value = value
-				}
-			} else if strings.HasPrefix(metricName, s.Conf.MaxPrefix) {
-				if workingList[metricName].value < value {
-					workingList[metricName].value = value
-				}
-			}
+		if s.Lc.aggrForwarder != nil {
+			s.queueAggrStates(now)
 		}
+
 		/*
 			We may have a problem, that working_list size will be bigger than main buffer/space in it.
 			But then go suppose to block appending into buffer and wait until space will be free.
 			I am not sure if we need to check free space of main buffer here...
 		*/
 		dropped := 0
-		for metricName, metricData := range workingList {
-			value := metricData.value
-			var prefix string
-
-			if strings.HasPrefix(metricName, s.Conf.SumPrefix) {
-				prefix = s.Conf.SumPrefix
-			} else if strings.HasPrefix(metricName, s.Conf.AvgPrefix) {
-				value = metricData.value / float64(metricData.amount)
-				prefix = s.Conf.AvgPrefix
-			} else if strings.HasPrefix(metricName, s.Conf.MinPrefix) {
-				prefix = s.Conf.MinPrefix
-			} else if strings.HasPrefix(metricName, s.Conf.MaxPrefix) {
-				prefix = s.Conf.MaxPrefix
-			}
-
+		for _, metric := range s.Lc.aggregator.flush(now) {
 			select {
-			case s.Lc.mainChannel <- fmt.Sprintf("%s %.2f %d", strings.Replace(metricName, prefix, "", -1), value, aggrTimestamp):
+			case s.Lc.mainChannel <- metric:
 			default:
 				s.Lc.lg.Printf("Too many metrics in the main queue (%d). I can not append aggregated metrics", len(s.Lc.mainChannel))
 				dropped++
@@ -96,48 +62,245 @@ func (s Server) aggrMetricsWithPrefix() {
 				s.Mon.Increase(&s.Mon.clientStat[carbonAddr].dropped, dropped)
 			}
 		}
+
+		// The state is saved right after an interval is sent to not restore already sent state after crash
+		if s.Conf.AggrStateFile != "" && (s.Lc.aggregator.lastSent() != sent || now >= nextSave) {
+			if err := s.Lc.aggregator.save(s.Conf.AggrStateFile); err != nil {
+				s.Lc.lg.Println(err)
+			}
+			nextSave = now + int64(s.Conf.AggrStateInterval)
+		}
 	}
 }
 
+// Apply overwrite rules to metric in order until the rule without continue flag is matched
 func (s *Server) overwriteName(metric *string) {
 	for i, re := range s.Lc.overwriteRegexp {
-		if re.MatchString(*metric) {
-			*metric = re.ReplaceAllString(*metric, s.Conf.Overwrite[i].ReplaceWith)
+		if !re.MatchString(*metric) {
+			continue
+		}
+		rule := &s.Conf.Overwrite[i]
+		var result string
+		switch rule.Action {
+		case overwriteLower:
+			result = re.ReplaceAllStringFunc(*metric, strings.ToLower)
+		case overwriteUpper:
+			result = re.ReplaceAllStringFunc(*metric, strings.ToUpper)
+		case overwriteSanitize:
+			result = re.ReplaceAllStringFunc(*metric, func(part string) string {
+				return sanitizeChars(part, rule.ReplaceWith)
+			})
+		default:
+			result = re.ReplaceAllString(*metric, rule.ReplaceWith)
+		}
+		if result != *metric {
+			s.Mon.increaseOverwrite(rule.Name)
+			*metric = result
+		}
+		if !rule.Continue {
 			return
 		}
 	}
 }
 
+// Count what was done with timestamp of a metric
+func (s Server) countTimestampResult(result timestampResult) {
+	if result&timestampFilled != 0 {
+		s.Mon.Increase(&s.Mon.serverStat.timestampFilled, 1)
+	}
+	if result&timestampConverted != 0 {
+		s.Mon.Increase(&s.Mon.serverStat.timestampConverted, 1)
+	}
+	if result&timestampClamped != 0 {
+		s.Mon.Increase(&s.Mon.serverStat.timestampClamped, 1)
+	}
+	if result&timestampRejected != 0 {
+		s.Mon.Increase(&s.Mon.serverStat.timestampRejected, 1)
+	}
+}
+
+// The result of processing of incoming metrics
+type ingestStat struct {
+	// Amount of metrics put into main or aggregation channel.
+	accepted int
+
+	// Amount of invalid metrics.
+	invalid int
+
+	// Amount of metrics dropped because of channel overflow.
+	dropped int
+
+	// Amount of metrics dropped because of limits of their prefixes.
+	limited int
+
+	// Indexes of invalid metrics in the incoming list.
+	rejected []int
+}
+
+// Parse metric and check its name against allowedNames and the whole metric against allowedMetrics.
+// Return the reason of rejection if metric is invalid.
+func (s Server) validateMetric(metric string) (Metric, string) {
+	m, reason := parseMetric(metric, s.Conf.MetricMaxLength)
+	if reason != "" {
+		return m, reason
+	}
+	if s.Lc.allowedNames != nil && !s.Lc.allowedNames.MatchString(m.Path) {
+		return m, rejectBadName
+	}
+	if s.Lc.allowedMetrics != nil && !s.Lc.allowedMetrics.MatchString(metric) {
+		return m, rejectNotAllowed
+	}
+	return m, ""
+}
+
+// Check if the rejected metric must be logged. Only every invalidLogSample-th of them is logged.
+func (s Server) sampleRejected() bool {
+	return atomic.AddUint64(&rejectedMetrics, 1)%uint64(s.Conf.InvalidLogSample) == 0
+}
+
+// Count rejected metric and log every invalidLogSample-th of them
+func (s Server) rejectMetric(metric string, reason string) {
+	s.Mon.Increase(&s.Mon.serverStat.invalid, 1)
+	switch reason {
+	case rejectBadName:
+		s.Mon.Increase(&s.Mon.serverStat.rejectedName, 1)
+	case rejectBadValue:
+		s.Mon.Increase(&s.Mon.serverStat.rejectedValue, 1)
+	case rejectBadTimestamp:
+		s.Mon.Increase(&s.Mon.serverStat.rejectedTimestamp, 1)
+	case rejectTooLong:
+		s.Mon.Increase(&s.Mon.serverStat.rejectedTooLong, 1)
+	case rejectNotAllowed:
+		s.Mon.Increase(&s.Mon.serverStat.rejectedNotAllowed, 1)
+	}
+
+	if !s.sampleRejected() {
+		return
+	}
+	if len(metric) > 256 {
+		metric = metric[:256] + "..."
+	}
+	s.Lc.lg.Printf("Removing bad metric '%s' from the list: %s", metric, reason)
+}
+
+// Results of routing of a metric
+const (
+	routeSent = iota
+	routeAggregated
+	routeDropped
+)
+
+// Put metric into aggregation channel, downsampler or main channel
+func (s Server) routeMetric(m Metric) int {
+	if s.Lc.aggrRegexp.MatchString(m.Path) {
+		select {
+		case s.Lc.aggrChannel <- m:
+			return routeAggregated
+		default:
+			s.Lc.lg.Println("Too many metrics in aggregating channel, drop metric: ", m.String())
+			return routeDropped
+		}
+	}
+	if s.Lc.downsampler != nil {
+		switch s.Lc.downsampler.add(m) {
+		case downsampleConsumed:
+			s.Mon.Increase(&s.Mon.serverStat.downsampled, 1)
+			return routeSent
+		case downsampleTooLate:
+			s.Mon.Increase(&s.Mon.serverStat.downsampleLate, 1)
+			return routeSent
+		}
+	}
+	select {
+	case s.Lc.mainChannel <- m.String():
+		return routeSent
+	default:
+		s.Lc.lg.Println("Too many metrics in main channel, drop metric: ", m.String())
+		return routeDropped
+	}
+}
+
 // Validate metrics list in order:
-// 1) Find proper channel for metric.
-// 2) Check overflow of the channel.
-// 3) Put metric in a proper channel.
-func (s Server) cleanAndUseIncomingData(metrics []string) {
+// 1) Apply overwrite rules and sanitize name of metric.
+// 2) Check and fix timestamp of metric.
+// 3) Parse and validate metric.
+// 4) Apply filter rules and limits of prefixes.
+// 5) Derive rates from counters.
+// 6) Find proper channel for metric or downsample it.
+// 7) Check overflow of the channel.
+// 8) Put metric in a proper channel.
+func (s Server) cleanAndUseIncomingData(metrics []string) ingestStat {
 	dropped := 0
 	aggregated := 0
-	for _, metric := range metrics {
+	accepted := 0
+	invalid := 0
+	limited := 0
+	var rejected []int
+	now := time.Now().Unix()
+	for i, metric := range metrics {
 		s.overwriteName(&metric)
-		if s.Lc.allowedMetrics.MatchString(metric) {
-			if s.Lc.aggrRegexp.MatchString(metric) {
-				select {
-				case s.Lc.aggrChannel <- metric:
-					aggregated++
-				default:
-					s.Lc.lg.Println("Too many metrics in aggregating channel, drop metric: ", metric)
-					dropped++
-				}
-			} else {
-				select {
-				case s.Lc.mainChannel <- metric:
-				default:
-					s.Lc.lg.Println("Too many metrics in main channel, drop metric: ", metric)
-					dropped++
-				}
+		if s.Conf.Sanitize {
+			var sanitized bool
+			if metric, sanitized = sanitizeMetric(metric, s.Conf.SanitizeMaxNodeLength, s.Lc.sanitizeRegexp); sanitized {
+				s.Mon.Increase(&s.Mon.serverStat.sanitized, 1)
 			}
-		} else {
-			if metric != "" {
-				s.Mon.Increase(&s.Mon.serverStat.invalid, 1)
-				s.Lc.lg.Printf("Removing bad metric '%s' from the list", metric)
+		}
+		var tsResult timestampResult
+		metric, tsResult = s.fixTimestamp(metric, now)
+		if tsResult != timestampKept {
+			s.countTimestampResult(tsResult)
+		}
+		if tsResult&timestampRejected != 0 {
+			s.rejectMetric(metric, rejectTimestampWindow)
+			invalid++
+			rejected = append(rejected, i)
+			continue
+		}
+		if strings.TrimSpace(metric) == "" {
+			continue
+		}
+		m, reason := s.validateMetric(metric)
+		if reason != "" {
+			s.rejectMetric(metric, reason)
+			invalid++
+			rejected = append(rejected, i)
+			continue
+		}
+		if s.Lc.cardinality != nil {
+			s.Lc.cardinality.add(m)
+		}
+		if !s.filterMetric(m) {
+			continue
+		}
+		if !s.limitMetric(m, now) {
+			limited++
+			continue
+		}
+
+		routed := []Metric{m}
+		if s.Lc.rates != nil {
+			rate, matched, keep := s.Lc.rates.derive(m)
+			if matched && !keep {
+				routed = routed[:0]
+			}
+			if rate != nil {
+				s.Mon.Increase(&s.Mon.serverStat.rates, 1)
+				routed = append(routed, *rate)
+			}
+			if len(routed) == 0 {
+				// The first point of a counter is used only to calculate the rate
+				accepted++
+			}
+		}
+		for _, m := range routed {
+			switch s.routeMetric(m) {
+			case routeAggregated:
+				aggregated++
+				accepted++
+			case routeDropped:
+				dropped++
+			default:
+				accepted++
 			}
 		}
 	}
@@ -151,6 +314,30 @@ func (s Server) cleanAndUseIncomingData(metrics []string) {
 			s.Mon.Increase(&s.Mon.clientStat[carbonAddr].aggregated, aggregated)
 		}
 	}
+	return ingestStat{accepted: accepted, invalid: invalid, dropped: dropped, limited: limited, rejected: rejected}
+}
+
+// Reading metrics in InfluxDB line protocol from network
+func (s Server) handleInfluxRequest(conn net.Conn) {
+	defer conn.Close()
+	conBuf := bufio.NewReader(conn)
+	for {
+		line, err := conBuf.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			s.Mon.Increase(&s.Mon.serverStat.influx, 1)
+			metrics, invalid := s.Lc.influxConverter.convertLines([]string{line})
+			if invalid > 0 {
+				s.Mon.Increase(&s.Mon.serverStat.invalid, invalid)
+				if s.sampleRejected() {
+					s.Lc.lg.Printf("Removing bad InfluxDB line protocol point '%s'", strings.TrimSpace(line))
+				}
+			}
+			s.cleanAndUseIncomingData(metrics)
+		}
+		if err != nil {
+			return
+		}
+	}
 }
 
 // Reading metrics from network
@@ -168,35 +355,207 @@ func (s Server) handleRequest(conn net.Conn) {
 	}
 }
 
+// Check if file in metricDir must be ignored
+func (s Server) ignoredMetricFile(name string) bool {
+	for _, pattern := range s.Conf.MetricDirIgnore {
+		if matched, _ := filepath.Match(pattern, filepath.Base(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Path of file with the name in quarantineDir
+func (s Server) quarantinePath(name string) string {
+	return filepath.Join(s.Conf.QuarantineDir,
+		fmt.Sprintf("%d_%s", time.Now().Unix(), strings.Replace(name, string(filepath.Separator), "_", -1)))
+}
+
+// Move file from metricDir to quarantineDir.
+// If quarantineDir is not set or file can not be moved - it is removed.
+func (s Server) quarantineMetricFile(name string, reason string) {
+	file := filepath.Join(s.Conf.MetricDir, name)
+	if s.Conf.QuarantineDir != "" {
+		dst := s.quarantinePath(name)
+		err := moveFile(file, dst)
+		if err == nil {
+			s.Lc.lg.Printf("Moved file %s to %s: %s", file, dst, reason)
+			s.Mon.Increase(&s.Mon.serverStat.quarantined, 1)
+			return
+		}
+		s.Lc.lg.Printf("Can not move file %s to quarantineDir: %s", file, err.Error())
+	}
+	s.Lc.lg.Printf("Removing file %s: %s", file, reason)
+	os.Remove(file)
+}
+
+// Write rejected metrics of file from metricDir to quarantineDir in Graphite plaintext format.
+// Valid metrics of the file are already sent, so they are not written to not send them twice.
+func (s Server) quarantineMetricLines(name string, metrics []string) {
+	dst := s.quarantinePath(name) + ".rejected"
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		s.Lc.lg.Printf("Can not write rejected metrics of %s to quarantineDir: %s", name, err.Error())
+		return
+	}
+	w := bufio.NewWriter(f)
+	for _, metric := range metrics {
+		w.WriteString(metric + "\n")
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		s.Lc.lg.Printf("Can not write rejected metrics of %s to quarantineDir: %s", name, err.Error())
+		os.Remove(dst)
+		return
+	}
+	s.Lc.lg.Printf("Moved %d rejected metrics of %s to %s", len(metrics), name, dst)
+	s.Mon.Increase(&s.Mon.serverStat.quarantined, 1)
+}
+
+// Log and count unreadable entry of metricDir only once, it is skipped on every read of metricDir
+func (s Server) reportUnreadable(file string, message string) {
+	if _, reported := unreadableFiles.LoadOrStore(file, true); reported {
+		return
+	}
+	s.Lc.lg.Println(message)
+	s.Mon.Increase(&s.Mon.serverStat.unreadable, 1)
+}
+
+// Reading metrics from a single file in metricDir.
+// Name is relative to metricDir.
+func (s Server) handleMetricFile(name string) {
+	if s.ignoredMetricFile(name) {
+		return
+	}
+	file := filepath.Join(s.Conf.MetricDir, name)
+	info, err := os.Stat(file)
+	if err != nil {
+		// File might be already consumed
+		if os.IsNotExist(err) {
+			unreadableFiles.Delete(file)
+		} else {
+			s.reportUnreadable(file, "Can not stat file in metricDir: "+err.Error())
+		}
+		return
+	}
+	if info.IsDir() {
+		return
+	}
+	if !info.Mode().IsRegular() {
+		s.reportUnreadable(file, fmt.Sprintf("Skipping %s in metricDir, it is not a regular file", file))
+		return
+	}
+	if s.Conf.MetricDirMaxFileSize > 0 && info.Size() > s.Conf.MetricDirMaxFileSize {
+		s.Mon.Increase(&s.Mon.serverStat.unreadable, 1)
+		s.quarantineMetricFile(name, fmt.Sprintf("size %d is bigger than %d", info.Size(), s.Conf.MetricDirMaxFileSize))
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		s.reportUnreadable(file, "Can not open file in metricDir: "+err.Error())
+		return
+	}
+	unreadableFiles.Delete(file)
+	// Metrics in other formats are converted to Graphite plaintext
+	resultsList, unconverted, readErr := readMetricsInFormat(name, f, s.Lc.influxConverter)
+	f.Close()
+	if unconverted > 0 {
+		s.Lc.lg.Printf("Can not convert %d metrics from file %s", unconverted, file)
+		s.Mon.Increase(&s.Mon.serverStat.invalid, unconverted)
+	}
+
+	src := s.metricDirSource(name)
+	if s.Conf.QuarantineDir != "" && (readErr != nil || unconverted > 0) {
+		// Metrics are not sent, so the whole file can be fed again after investigation
+		if src != nil {
+			s.Mon.increaseDirSource(src.name, len(resultsList)+unconverted, unconverted)
+		}
+		if readErr != nil {
+			s.Mon.Increase(&s.Mon.serverStat.unreadable, 1)
+			s.quarantineMetricFile(name, "can not read file completely: "+readErr.Error())
+		} else {
+			s.quarantineMetricFile(name, fmt.Sprintf("contains %d metrics, which can not be converted", unconverted))
+		}
+		return
+	}
+
+	metrics := resultsList
+	if src != nil {
+		metrics = make([]string, len(resultsList))
+		for i := range resultsList {
+			metrics[i] = src.apply(resultsList[i])
+		}
+	}
+
+	s.Mon.Increase(&s.Mon.serverStat.dir, len(metrics))
+	stat := s.cleanAndUseIncomingData(metrics)
+	invalid := stat.invalid + unconverted
+	if src != nil {
+		s.Mon.increaseDirSource(src.name, len(metrics)+unconverted, invalid)
+	}
+
+	if readErr != nil {
+		s.Mon.Increase(&s.Mon.serverStat.unreadable, 1)
+		s.quarantineMetricFile(name, "can not read file completely: "+readErr.Error())
+		return
+	}
+	if len(stat.rejected) > 0 && s.Conf.QuarantineDir != "" {
+		rejected := make([]string, len(stat.rejected))
+		for i, index := range stat.rejected {
+			rejected[i] = resultsList[index]
+		}
+		s.quarantineMetricLines(name, rejected)
+	}
+	os.Remove(file)
+}
+
+// Reading metrics from all files in directory of metricDir.
+// Dir is relative to metricDir.
+func (s Server) readDirMetrics(dir string) {
+	entries, err := os.ReadDir(filepath.Join(s.Conf.MetricDir, dir))
+	if err != nil {
+		// Entries, which were read before the error, are still processed
+		s.Lc.lg.Println("Can not read directory in metricDir:", err.Error())
+		s.Mon.Increase(&s.Mon.serverStat.unreadable, 1)
+	}
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if s.Conf.MetricDirRecursive && !s.ignoredMetricFile(name) {
+				s.readDirMetrics(name)
+			}
+			continue
+		}
+		s.handleMetricFile(name)
+	}
+}
+
 // Reading metrics from files in folder.
 // This is a second way how to send metrics, except network.
 func (s Server) handleDirMetrics() {
+	if s.Conf.MetricDirInotify {
+		err := s.watchDirMetrics()
+		s.Lc.lg.Println("Can not watch metricDir, falling back to polling:", err.Error())
+	}
 	for ; ; time.Sleep(time.Duration(s.Conf.ClientSendInterval) * time.Second) {
-		entries, err := os.ReadDir(s.Conf.MetricDir)
-		if err != nil {
-			panic(err.Error())
-		}
-		for _, entry := range entries {
-			info, err := entry.Info()
-			if err != nil {
-				panic(err.Error())
-			}
-			resultsList, _ := readMetricsFromFile(s.Conf.MetricDir + "/" + info.Name())
-			s.Mon.Increase(&s.Mon.serverStat.dir, len(resultsList))
-			s.cleanAndUseIncomingData(resultsList)
-		}
+		s.readDirMetrics("")
 	}
 }
 
 // handleListener handles incoming connections
-func (s *Server) handleListener(addr *net.TCPAddr) {
+func (s *Server) handleListener(addr *net.TCPAddr, handler func(net.Conn)) {
 	// Listen for incoming connections.
 	l, err := net.ListenTCP("tcp", addr)
 	if err != nil {
 		s.Lc.lg.Println("Failed to run server:", err.Error())
 		os.Exit(1)
 	} else {
-		s.Lc.lg.Println("Server is running")
+		s.Lc.lg.Println("Server is running on", addr.String())
 	}
 	defer l.Close()
 
@@ -208,7 +567,7 @@ func (s *Server) handleListener(addr *net.TCPAddr) {
 			os.Exit(1)
 		}
 		// Handle connections in a new goroutine.
-		go s.handleRequest(conn)
+		go handler(conn)
 	}
 }
 
@@ -220,9 +579,9 @@ func (s *Server) handleListener(addr *net.TCPAddr) {
 //
 // Example:
 // localhost:ssh -> [127.0.0.1:22, [::1]:22]
-func (s *Server) resolveBind() []*net.TCPAddr {
+func (s *Server) resolveBind(bind string) []*net.TCPAddr {
 	// Resolve hostname to ips
-	h, p, err := net.SplitHostPort(s.Conf.LocalBind)
+	h, p, err := net.SplitHostPort(bind)
 	if err != nil {
 		s.Lc.lg.Println("Failed to split bind address:", err.Error())
 		os.Exit(1)
@@ -257,14 +616,36 @@ func (s *Server) resolveBind() []*net.TCPAddr {
 // Should be run in separate goroutine.
 func (s *Server) Run() {
 	// Resolve listen endpoints and start listeners
-	for _, addr := range s.resolveBind() {
-		go s.handleListener(addr)
+	for _, addr := range s.resolveBind(s.Conf.LocalBind) {
+		go s.handleListener(addr, s.handleRequest)
+	}
+	if s.Conf.InfluxBind != "" {
+		for _, addr := range s.resolveBind(s.Conf.InfluxBind) {
+			go s.handleListener(addr, s.handleInfluxRequest)
+		}
+	}
+
+	if s.Conf.HTTPBind != "" {
+		go s.handleHTTP()
+	}
+
+	// Run goroutine per Prometheus endpoint to scrape
+	for _, target := range s.Conf.Scrape {
+		go s.handleScrape(target)
 	}
 
 	// Run goroutine for reading metrics from metricDir
 	go s.handleDirMetrics()
 	// Run goroutine for aggr metrics with prefix
+	s.loadAggrState()
 	go s.aggrMetricsWithPrefix()
+	if s.Lc.aggrForwarder != nil {
+		go s.forwardAggrStates()
+	}
+	// Run goroutine for downsampled metrics
+	if s.Lc.downsampler != nil {
+		go s.downsampleMetrics()
+	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -0,0 +1,76 @@
+package grafsy
+
+import (
+	"sort"
+	"strings"
+)
+
+// The name of template part, which is replaced with all tags not used in the template
+const templateTags = "tags"
+
+// Template to build Graphite path from named parts separated by dots, e.g. "measurement.host.field".
+// Parts without values are skipped.
+// The special part "tags" is replaced with values of all unused tags sorted by their names.
+type pathTemplate []string
+
+// Parse template separated by dots
+func parsePathTemplate(template string) pathTemplate {
+	var t pathTemplate
+	for _, part := range strings.Split(template, ".") {
+		if part != "" {
+			t = append(t, part)
+		}
+	}
+	return t
+}
+
+// Build Graphite path from special values (e.g. measurement or field) and tags.
+// Special values have priority over tags with the same name. They are used as is, so they must be safe for Graphite.
+// Return the path and Graphite tags in format ;tag1=value1;tag2=value2 built from the tags not used in the path.
+// Unused tags are dropped if dropTags is true.
+func (t pathTemplate) build(special map[string]string, tags map[string]string, dropTags bool) (string, string) {
+	used := make(map[string]bool)
+	parts := make([]string, 0, len(t))
+	tagsPart := -1
+	for _, name := range t {
+		if value, ok := special[name]; ok {
+			if value != "" {
+				parts = append(parts, value)
+			}
+			continue
+		}
+		if name == templateTags {
+			tagsPart = len(parts)
+			continue
+		}
+		if value, ok := tags[name]; ok && value != "" {
+			parts = append(parts, graphiteSafe(value))
+			used[name] = true
+		}
+	}
+
+	unused := make([]string, 0, len(tags))
+	for name := range tags {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+
+	if tagsPart >= 0 {
+		values := make([]string, 0, len(unused))
+		for _, name := range unused {
+			values = append(values, graphiteSafe(tags[name]))
+		}
+		parts = append(parts[:tagsPart], append(values, parts[tagsPart:]...)...)
+		return strings.Join(parts, "."), ""
+	}
+
+	var graphiteTags string
+	if !dropTags {
+		for _, name := range unused {
+			graphiteTags += ";" + graphiteSafe(name) + "=" + graphiteTagSafe(tags[name])
+		}
+	}
+	return strings.Join(parts, "."), graphiteTags
+}
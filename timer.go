@@ -0,0 +1,196 @@
+package grafsy
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default percentiles calculated for timers
+var defaultTimerPercentiles = []float64{50, 90, 99}
+
+// Relative accuracy of percentiles of timers merged from other grafsy instances
+const timerSketchAccuracy = 0.01
+
+// Bin of values not greater than zero in timer sketch
+const timerSketchZeroBin = math.MinInt32
+
+// Base of logarithmic bins of timer sketch
+var timerSketchGamma = (1 + timerSketchAccuracy) / (1 - timerSketchAccuracy)
+
+// Summary of timer values of bounded size, which is forwarded to the central grafsy instead of raw values.
+// Values are counted in logarithmic bins, so percentiles are estimated with timerSketchAccuracy.
+type timerSketch struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+
+	// Amount of values by index of bin.
+	Bins map[int]int64 `json:"bins"`
+}
+
+// Raw values of a timer during aggregation interval
+type timerData struct {
+	// Path of the timer without prefix.
+	path string
+	tags []string
+
+	values []float64
+
+	// Values merged from other grafsy instances.
+	sketch *timerSketch
+}
+
+// Index of bin of the value
+func timerSketchBin(value float64) int {
+	if value <= 0 {
+		return timerSketchZeroBin
+	}
+	return int(math.Ceil(math.Log(value) / math.Log(timerSketchGamma)))
+}
+
+// Value representing all values of the bin
+func timerSketchValue(bin int) float64 {
+	if bin == timerSketchZeroBin {
+		return 0
+	}
+	return 2 * math.Pow(timerSketchGamma, float64(bin)) / (timerSketchGamma + 1)
+}
+
+// Add raw values to the sketch
+func (s *timerSketch) add(values ...float64) {
+	if s.Bins == nil {
+		s.Bins = make(map[int]int64)
+	}
+	for _, value := range values {
+		if s.Count == 0 || value < s.Min {
+			s.Min = value
+		}
+		if s.Count == 0 || value > s.Max {
+			s.Max = value
+		}
+		s.Count++
+		s.Sum += value
+		s.Bins[timerSketchBin(value)]++
+	}
+}
+
+// Merge other sketch into the sketch
+func (s *timerSketch) merge(other *timerSketch) {
+	if other == nil || other.Count == 0 {
+		return
+	}
+	if s.Bins == nil {
+		s.Bins = make(map[int]int64)
+	}
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+	for bin, count := range other.Bins {
+		s.Bins[bin] += count
+	}
+}
+
+// Get indexes of bins in ascending order
+func (s *timerSketch) bins() []int {
+	bins := make([]int, 0, len(s.Bins))
+	for bin := range s.Bins {
+		bins = append(bins, bin)
+	}
+	sort.Ints(bins)
+	return bins
+}
+
+// Get summary of raw and merged values of the timer
+func (t *timerData) summary() *timerSketch {
+	s := &timerSketch{}
+	s.merge(t.sketch)
+	s.add(t.values...)
+	return s
+}
+
+// Format upper bound of bucket as a part of Graphite path, e.g. 0.5 -> le_0_5
+func bucketName(bound float64) string {
+	return "le_" + strings.Replace(strconv.FormatFloat(bound, 'f', -1, 64), ".", "_", -1)
+}
+
+// Calculate count, sum, min, max, mean, percentiles and cumulative bucket counts of the timer.
+// Timer without values has no metrics.
+// Percentiles are calculated by nearest rank, buckets must be sorted in ascending order.
+// Percentiles and buckets of timers with merged values are estimated from the sketch.
+func (t *timerData) metrics(percentiles []float64, buckets []float64, timestamp int64) []Metric {
+	if len(t.values) == 0 && (t.sketch == nil || t.sketch.Count <= 0) {
+		return nil
+	}
+	var count int
+	var sum, min, max float64
+	// Value of the rank and amount of values not greater than the bound
+	var rankValue func(rank int) float64
+	var below func(bound float64) int
+
+	if t.sketch == nil {
+		sort.Float64s(t.values)
+		count = len(t.values)
+		for _, value := range t.values {
+			sum += value
+		}
+		min, max = t.values[0], t.values[count-1]
+		rankValue = func(rank int) float64 { return t.values[rank-1] }
+		below = func(bound float64) int { return sort.Search(count, func(i int) bool { return t.values[i] > bound }) }
+	} else {
+		s := t.summary()
+		bins := s.bins()
+		count, sum, min, max = int(s.Count), s.Sum, s.Min, s.Max
+		rankValue = func(rank int) float64 {
+			var cumulative int64
+			for _, bin := range bins {
+				cumulative += s.Bins[bin]
+				if cumulative >= int64(rank) {
+					return math.Max(min, math.Min(max, timerSketchValue(bin)))
+				}
+			}
+			return max
+		}
+		below = func(bound float64) int {
+			var cumulative int64
+			for _, bin := range bins {
+				if timerSketchValue(bin) > bound {
+					break
+				}
+				cumulative += s.Bins[bin]
+			}
+			return int(cumulative)
+		}
+	}
+
+	var result []Metric
+	add := func(suffix string, value float64) {
+		result = append(result, Metric{Path: t.path + "." + suffix, Tags: t.tags, Value: value, Timestamp: timestamp})
+	}
+	add("count", float64(count))
+	add("sum", sum)
+	add("min", min)
+	add("max", max)
+	add("mean", sum/float64(count))
+	for _, p := range percentiles {
+		rank := int(math.Ceil(p / 100 * float64(count)))
+		if rank < 1 {
+			rank = 1
+		}
+		add(percentileName(p), rankValue(rank))
+	}
+	if len(buckets) > 0 {
+		for _, bound := range buckets {
+			add("bucket."+bucketName(bound), float64(below(bound)))
+		}
+		add("bucket.le_inf", float64(count))
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package grafsy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Actions on out of window timestamps
+const (
+	timestampReject = "reject"
+	timestampClamp  = "clamp"
+)
+
+// What was done with timestamp of a metric. Converted timestamp might be clamped as well.
+type timestampResult int
+
+const (
+	timestampFilled timestampResult = 1 << iota
+	timestampConverted
+	timestampClamped
+	timestampRejected
+
+	timestampKept timestampResult = 0
+)
+
+// Check timestamp of metric in format <name> <value> [timestamp] and fix it according to config:
+//  1. Missing, "-1" and "N" timestamps are replaced with now.
+//  2. Timestamps in milliseconds, microseconds and nanoseconds are converted to seconds.
+//  3. Timestamps outside of [now-TimestampMaxPast, now+TimestampMaxFuture] are rejected or clamped.
+//
+// Metrics, which can not be parsed, are returned as is and left for the parser to reject.
+func (s Server) fixTimestamp(metric string, now int64) (string, timestampResult) {
+	if !s.Conf.TimestampFill && !s.Conf.TimestampConvert && s.Conf.TimestampMaxPast <= 0 && s.Conf.TimestampMaxFuture <= 0 {
+		return metric, timestampKept
+	}
+
+	fields := strings.Fields(metric)
+	result := timestampKept
+	var timestamp int64
+	switch {
+	case len(fields) == 2 || len(fields) == 3 && (fields[2] == "-1" || fields[2] == "N"):
+		if !s.Conf.TimestampFill {
+			return metric, timestampKept
+		}
+		timestamp = now
+		result = timestampFilled
+	case len(fields) == 3:
+		var err error
+		timestamp, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return metric, timestampKept
+		}
+		if s.Conf.TimestampConvert {
+			for _, divider := range []int64{1e9, 1e6, 1e3} {
+				// Timestamps in seconds will be that big only in tens of thousands of years
+				if timestamp/divider >= 1e9 {
+					timestamp /= divider
+					result |= timestampConverted
+					break
+				}
+			}
+		}
+	default:
+		return metric, timestampKept
+	}
+
+	if s.Conf.TimestampMaxPast > 0 && timestamp < now-int64(s.Conf.TimestampMaxPast) {
+		if s.Conf.TimestampOutOfWindow != timestampClamp {
+			return metric, result | timestampRejected
+		}
+		timestamp = now - int64(s.Conf.TimestampMaxPast)
+		result |= timestampClamped
+	}
+	if s.Conf.TimestampMaxFuture > 0 && timestamp > now+int64(s.Conf.TimestampMaxFuture) {
+		if s.Conf.TimestampOutOfWindow != timestampClamp {
+			return metric, result | timestampRejected
+		}
+		timestamp = now + int64(s.Conf.TimestampMaxFuture)
+		result |= timestampClamped
+	}
+
+	if result == timestampKept {
+		return metric, result
+	}
+	return fields[0] + " " + fields[1] + " " + strconv.FormatInt(timestamp, 10), result
+}